@@ -0,0 +1,99 @@
+package compress
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+)
+
+// cacheKey identifies a compressed representation. The validator is the ETag
+// or, lacking one, the Last-Modified date of the response.
+type cacheKey struct {
+	url       string
+	coding    compType
+	validator string
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	body []byte
+}
+
+// responseCache is a LRU cache of compressed responses limited by the total
+// size of the stored bodies
+type responseCache struct {
+	mu     sync.Mutex
+	budget int64
+	size   int64
+	ll     *list.List // most recently used in front
+	items  map[cacheKey]*list.Element
+}
+
+func newResponseCache(budget int64) *responseCache {
+	return &responseCache{
+		budget: budget,
+		ll:     list.New(),
+		items:  make(map[cacheKey]*list.Element),
+	}
+}
+
+func (rc *responseCache) get(key cacheKey) ([]byte, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	e, ok := rc.items[key]
+	if !ok {
+		return nil, false
+	}
+	rc.ll.MoveToFront(e)
+	return e.Value.(*cacheEntry).body, true
+}
+
+// add stores a copy of body, evicting the least recently used entries until
+// it fits into the budget
+func (rc *responseCache) add(key cacheKey, body []byte) {
+	size := int64(len(body))
+	if size > rc.budget {
+		return
+	}
+	entry := &cacheEntry{key, append([]byte(nil), body...)}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if e, ok := rc.items[key]; ok {
+		rc.remove(e)
+	}
+	for rc.size+size > rc.budget {
+		rc.remove(rc.ll.Back())
+	}
+	rc.items[key] = rc.ll.PushFront(entry)
+	rc.size += size
+}
+
+func (rc *responseCache) remove(e *list.Element) {
+	entry := rc.ll.Remove(e).(*cacheEntry)
+	delete(rc.items, entry.key)
+	rc.size -= int64(len(entry.body))
+}
+
+// responseCacheKey returns the key of the response to r, if it can be cached.
+// Only complete responses to GET requests with validators qualify, that vary
+// by nothing but Accept-Encoding. HEAD requests get the key of the GET request
+// to look up the size of the content.
+func responseCacheKey(r *http.Request, c compType, code int, hdr http.Header) (cacheKey, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || code != http.StatusOK {
+		return cacheKey{}, false
+	}
+	for _, field := range splitHeaderList(hdr, hdrVary) {
+		if http.CanonicalHeaderKey(field) != hdrAcceptEncoding {
+			return cacheKey{}, false
+		}
+	}
+	validator := hdr.Get(hdrETag)
+	if validator == "" {
+		validator = hdr.Get(hdrLastModified)
+	}
+	if validator == "" {
+		return cacheKey{}, false
+	}
+	return cacheKey{r.Host + r.URL.RequestURI(), c, validator}, true
+}
@@ -0,0 +1,142 @@
+package compress
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestResponseCacheEviction(t *testing.T) {
+	key := func(url string) cacheKey { return cacheKey{url, compGzip, `"v1"`} }
+	rc := newResponseCache(10)
+	rc.add(key("a"), []byte("aaaa"))
+	rc.add(key("b"), []byte("bbbb"))
+	if _, ok := rc.get(key("a")); !ok {
+		t.Fatal("a missing")
+	}
+	// b is the least recently used now
+	rc.add(key("c"), []byte("cccc"))
+	for url, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := rc.get(key(url)); ok != want {
+			t.Errorf("%s cached %v, want %v", url, ok, want)
+		}
+	}
+
+	// Replacing an entry frees its old size
+	rc.add(key("a"), []byte("aa"))
+	if body, _ := rc.get(key("a")); string(body) != "aa" {
+		t.Errorf("a is %q", body)
+	}
+	if rc.size != 6 {
+		t.Errorf("size %d, want 6", rc.size)
+	}
+
+	// Bodies larger than the budget are not stored and evict nothing
+	rc.add(key("d"), []byte("ddddddddddd"))
+	if _, ok := rc.get(key("d")); ok {
+		t.Error("d cached")
+	}
+	if rc.ll.Len() != 2 {
+		t.Errorf("%d entries, want 2", rc.ll.Len())
+	}
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		method string
+		code   int
+		kv     []string
+		ok     bool
+	}{
+		{"etag", http.MethodGet, http.StatusOK, []string{hdrETag, `"v1"`}, true},
+		{"last-modified", http.MethodGet, http.StatusOK, []string{hdrLastModified, "Wed, 21 Oct 2015 07:28:00 GMT"}, true},
+		{"head", http.MethodHead, http.StatusOK, []string{hdrETag, `"v1"`}, true},
+		{"no validator", http.MethodGet, http.StatusOK, nil, false},
+		{"post", http.MethodPost, http.StatusOK, []string{hdrETag, `"v1"`}, false},
+		{"partial", http.MethodGet, http.StatusPartialContent, []string{hdrETag, `"v1"`}, false},
+		{"vary accept-encoding", http.MethodGet, http.StatusOK, []string{hdrETag, `"v1"`, hdrVary, "accept-encoding"}, true},
+		{"vary cookie", http.MethodGet, http.StatusOK, []string{hdrETag, `"v1"`, hdrVary, "Accept-Encoding, Cookie"}, false},
+	} {
+		req := httptest.NewRequest(tc.method, "/path?q=1", nil)
+		hdr := http.Header{}
+		for i := 0; i+1 < len(tc.kv); i += 2 {
+			hdr.Set(tc.kv[i], tc.kv[i+1])
+		}
+		key, ok := responseCacheKey(req, compGzip, tc.code, hdr)
+		if ok != tc.ok {
+			t.Errorf("%s: cacheable %v, want %v", tc.name, ok, tc.ok)
+		}
+		if ok && (key.url != "example.com/path?q=1" || key.validator != tc.kv[1]) {
+			t.Errorf("%s: key %+v", tc.name, key)
+		}
+	}
+}
+
+func TestCache(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	etag := `"v1"`
+	vary := ""
+	var runs int
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runs++
+		w.Header().Set(hdrContentType, "text/plain")
+		w.Header().Set(hdrETag, etag)
+		if vary != "" {
+			w.Header().Set(hdrVary, vary)
+		}
+		io.WriteString(w, content)
+	}), WithCache(1<<20), WithDebugHeaders())
+	do := func(method string) *http.Response {
+		req := httptest.NewRequest(method, "/", nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+	hit := func(res *http.Response) bool {
+		return res.Header.Get(hdrXCompressEncoder) == "gzip; cached"
+	}
+
+	var cachedSize int
+	for i, step := range []struct {
+		name   string
+		method string
+		etag   string
+		vary   string
+		hit    bool
+	}{
+		{"miss", http.MethodGet, `"v1"`, "", false},
+		{"hit", http.MethodGet, `"v1"`, "", true},
+		{"head", http.MethodHead, `"v1"`, "", false},
+		{"changed etag", http.MethodGet, `"v2"`, "", false},
+		{"hit changed etag", http.MethodGet, `"v2"`, "", true},
+		{"vary", http.MethodGet, `"v3"`, "Cookie", false},
+		{"vary again", http.MethodGet, `"v3"`, "Cookie", false},
+	} {
+		etag, vary = step.etag, step.vary
+		res := do(step.method)
+		body, _ := io.ReadAll(res.Body)
+
+		if runs != i+1 {
+			t.Errorf("%s: handler ran %d times, want %d", step.name, runs, i+1)
+		}
+		if hit(res) != step.hit {
+			t.Errorf("%s: hit %v, want %v", step.name, hit(res), step.hit)
+		}
+		if step.method == http.MethodHead {
+			// The size of the cached content is known
+			if cl := res.Header.Get(hdrContentLength); cl != strconv.Itoa(cachedSize) {
+				t.Errorf("%s: Content-Length %q, want %d", step.name, cl, cachedSize)
+			}
+			continue
+		}
+		cachedSize = len(body)
+		if got := decode(t, "gzip", body); string(got) != content {
+			t.Errorf("%s: got %d bytes, want %d", step.name, len(got), len(content))
+		}
+	}
+}
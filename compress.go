@@ -1,274 +1,2240 @@
-// Package compress provides a middleware for compression via gzip and deflate.
+// Package compress provides a middleware for compression via brotli, zstd,
+// gzip and deflate.
 package compress
 
 import (
+	"bufio"
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
 	"io"
-	"log"
+	"math"
+	"math/big"
+	"mime"
+	"net"
 	"net/http"
+	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 )
 
+// Default values of the package level settings
+const (
+	DefaultCompressMinLength = 256
+	DefaultCompressMaxBuf    = 16 * 1024
+)
+
+// The package level settings are the defaults for all middlewares created
+// afterwards. Use WithMinLength and WithMaxBuf to configure a single
+// middleware instead.
 var (
 	// CompressMinLength is the lower bound for compression. Smaller files
 	// won't be compressed.
-	CompressMinLength = 256
-	// CompressMaxBuf is the upper bound for buffered compression. Larger files
-	// will be compressed on-the-fly.
-	CompressMaxBuf = 16 * 1024
+	CompressMinLength = DefaultCompressMinLength
+	// CompressMaxBuf is the upper bound for buffered compression. Once a
+	// response grows beyond this size, it will be compressed on-the-fly.
+	// This is a hard limit, that applies regardless of the Content-Length
+	// announced by the handler.
+	CompressMaxBuf = DefaultCompressMaxBuf
+)
+
+// ResetDefaults restores the default values of the package level settings.
+// Tests that change them should call it during teardown, so they don't
+// affect other tests:
+//
+//	compress.CompressMinLength = 0
+//	defer compress.ResetDefaults()
+func ResetDefaults() {
+	CompressMinLength = DefaultCompressMinLength
+	CompressMaxBuf = DefaultCompressMaxBuf
+}
+
+// List of used header keys and values, because typing
+const (
+	hdrAcceptEncoding          = "Accept-Encoding"
+	hdrAcceptRanges            = "Accept-Ranges"
+	hdrAuthorization           = "Authorization"
+	hdrCacheControl            = "Cache-Control"
+	hdrCacheControlNoTransform = "no-transform"
+	hdrConnection              = "Connection"
+	hdrContentEncoding         = "Content-Encoding"
+	hdrContentEncodingGzip     = "gzip"
+	hdrContentEncodingDeflate  = "deflate"
+	hdrContentEncodingZstd     = "zstd"
+	hdrContentEncodingBrotli   = "br"
+	hdrContentEncodingIdentity = "identity"
+	hdrContentLanguage         = "Content-Language"
+	hdrContentLength           = "Content-Length"
+	hdrContentRange            = "Content-Range"
+	hdrContentType             = "Content-Type"
+	hdrDigest                  = "Digest"
+	hdrETag                    = "ETag"
+	hdrIfMatch                 = "If-Match"
+	hdrIfNoneMatch             = "If-None-Match"
+	hdrLastModified            = "Last-Modified"
+	hdrPrefer                  = "Prefer"
+	hdrPreferNoCompression     = "no-compression"
+	hdrRange                   = "Range"
+	hdrServerTiming            = "Server-Timing"
+	hdrSetCookie               = "Set-Cookie"
+	hdrTrailer                 = "Trailer"
+	hdrTransferEncoding        = "Transfer-Encoding"
+	hdrUpgrade                 = "Upgrade"
+	hdrVary                    = "Vary"
+
+	hdrXCompressEncoder        = "X-Compress-Encoder"
+	hdrXCompressOriginalLength = "X-Compress-Original-Length"
+	hdrXCompressRatio          = "X-Compress-Ratio"
+	hdrXCompressSkipped        = "X-Compress-Skipped"
+)
+
+/***********************************************\
+* Fused brotli + gzip + deflate compressor type *
+\***********************************************/
+
+// WriteCloseFlusher is the interface a compressor has to implement. It is
+// satisfied by *gzip.Writer and *flate.Writer.
+type WriteCloseFlusher interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// FlushMode selects how the compressor is flushed
+type FlushMode int
+
+// Supported flush modes
+const (
+	// FlushNone doesn't flush at all
+	FlushNone FlushMode = iota
+	// FlushSync flushes all pending data to the client
+	FlushSync
+	// FlushFull additionally resets the compressor state, so the following
+	// data can be decompressed independently of the preceding data. This is
+	// only supported by deflate without a dictionary, everything else falls
+	// back to FlushSync.
+	FlushFull
+)
+
+type fullFlusher interface {
+	FullFlush() error
+}
+
+// errWriterClosed is returned by pooled compressors used after Close, as they
+// may belong to another response already
+var errWriterClosed = errors.New("Use of compressor after Close")
+
+// flateWriter adds full flushes to flate.Writer and returns it to its pool on
+// the first Close
+type flateWriter struct {
+	*flate.Writer
+	w    io.Writer
+	pool *sync.Pool
+
+	closed bool
+	err    error // result of Close
+}
+
+func (f *flateWriter) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, errWriterClosed
+	}
+	return f.Writer.Write(p)
+}
+
+func (f *flateWriter) Flush() error {
+	if f.closed {
+		return errWriterClosed
+	}
+	return f.Writer.Flush()
+}
+
+func (f *flateWriter) FullFlush() error {
+	if err := f.Flush(); err != nil {
+		return err
+	}
+	f.Reset(f.w)
+	return nil
+}
+
+func (f *flateWriter) Close() error {
+	if f.closed {
+		return f.err
+	}
+	f.closed = true
+	f.err = f.Writer.Close()
+	if f.err == nil && f.pool != nil {
+		f.Reset(nil)
+		f.pool.Put(f.Writer)
+	}
+	return f.err
+}
+
+// gzipWriter returns the gzip.Writer to its pool on the first Close
+type gzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+
+	closed bool
+	err    error // result of Close
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if g.closed {
+		return 0, errWriterClosed
+	}
+	return g.Writer.Write(p)
+}
+
+func (g *gzipWriter) Flush() error {
+	if g.closed {
+		return errWriterClosed
+	}
+	return g.Writer.Flush()
+}
+
+func (g *gzipWriter) Close() error {
+	if g.closed {
+		return g.err
+	}
+	g.closed = true
+	g.err = g.Writer.Close()
+	if g.err == nil {
+		g.Reset(nil)
+		g.pool.Put(g.Writer)
+	}
+	return g.err
+}
+
+// compType is the name of a registered coding
+type compType string
+
+const (
+	compNone    = compType("")
+	compGzip    = compType(hdrContentEncodingGzip)
+	compDeflate = compType(hdrContentEncodingDeflate)
+	compZstd    = compType(hdrContentEncodingZstd)
+	compBrotli  = compType(hdrContentEncodingBrotli)
 )
 
-// List of used header keys and values, because typing
-const (
-	hdrAcceptEncoding         = "Accept-Encoding"
-	hdrContentEncoding        = "Content-Encoding"
-	hdrContentEncodingGzip    = "gzip"
-	hdrContentEncodingDeflate = "deflate"
-	hdrContentLength          = "Content-Length"
-	hdrContentType            = "Content-Type"
-	hdrTrailer                = "Trailer"
-	hdrVary                   = "Vary"
-)
+func (c compType) String() string {
+	if c == compNone {
+		return "none"
+	}
+	return string(c)
+}
+
+// registeredCoding holds the settings of a coding registered via
+// RegisterCoding
+type registeredCoding struct {
+	factory    CompressorFactory
+	preference int
+	builtin    bool
+}
+
+var (
+	codingsMu sync.RWMutex
+	codings   = map[compType]registeredCoding{
+		compBrotli:  {newBrotliWriter, 4, true},
+		compZstd:    {newZstdWriter, 3, true},
+		compGzip:    {newGzipWriter, 2, true},
+		compDeflate: {newFlateWriter, 1, true},
+	}
+)
+
+/*
+RegisterCoding makes the coding token available to all middlewares created
+afterwards. The factory has to create compressors writing to w with the given
+level. If clients accept several codings with the same quality value, the one
+with the highest preference is chosen. gzip and deflate are registered with
+preferences 2 and 1, zstd and br with preferences 3 and 4. Registering a token
+again replaces the previous registration. RegisterCoding is safe for
+concurrent use and is meant to be called during init:
+
+	func newLZ4Writer(w io.Writer, level int) (compress.WriteCloseFlusher, error) {
+		return lz4.NewWriter(w), nil
+	}
+
+	func init() {
+		compress.RegisterCoding("lz4", newLZ4Writer, 5)
+	}
+*/
+func RegisterCoding(token string, factory CompressorFactory, preference int) {
+	codingsMu.Lock()
+	defer codingsMu.Unlock()
+	codings[toCompType(token)] = registeredCoding{factory, preference, false}
+}
+
+// Encoder is a coding that can be plugged into the middleware, e.g. a faster
+// gzip implementation or lz4 for internal services.
+type Encoder interface {
+	// Name is the token used in Accept-Encoding and Content-Encoding
+	Name() string
+	// Priority decides between codings the client accepts equally
+	Priority() int
+	// NewWriter creates a compressor writing to w with the given level
+	NewWriter(w io.Writer, level int) (WriteCloseFlusher, error)
+}
+
+// RegisterEncoder makes e available to all middlewares created afterwards.
+// It is equivalent to RegisterCoding with the name, writer and priority of e.
+func RegisterEncoder(e Encoder) {
+	RegisterCoding(e.Name(), e.NewWriter, e.Priority())
+}
+
+// lookupCoding returns the registration of coding c
+func lookupCoding(c compType) (registeredCoding, bool) {
+	codingsMu.RLock()
+	defer codingsMu.RUnlock()
+	rc, ok := codings[c]
+	return rc, ok
+}
+
+// registeredCodings returns the preferences of all registered codings
+func registeredCodings() map[compType]int {
+	codingsMu.RLock()
+	defer codingsMu.RUnlock()
+	prefs := make(map[compType]int, len(codings))
+	for c, rc := range codings {
+		prefs[c] = rc.preference
+	}
+	return prefs
+}
+
+// toCompType returns the compType of a Content-Encoding
+func toCompType(coding string) compType {
+	return compType(strings.ToLower(strings.TrimSpace(coding)))
+}
+
+// compMagic holds the bytes every content starts with for codings that have
+// such a signature. Raw deflate has none.
+var compMagic = map[compType][]byte{
+	compGzip: {0x1f, 0x8b},
+	compZstd: {0x28, 0xb5, 0x2f, 0xfd},
+}
+
+// parseCoding splits an element of Accept-Encoding into the lower case coding
+// and its quality value. A missing quality value counts as 1. Elements with
+// invalid quality values are not ok.
+func parseCoding(elem string) (coding string, q float64, ok bool) {
+	params := strings.Split(elem, ";")
+	coding = strings.ToLower(strings.TrimSpace(params[0]))
+	q = 1.0
+	for _, param := range params[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "q") {
+			continue
+		}
+		if q, ok = parseQValue(strings.TrimSpace(kv[1])); !ok {
+			return coding, 0, false
+		}
+	}
+	return coding, q, coding != ""
+}
+
+// parseQValue parses a quality value, which is a number between 0 and 1 with
+// at most three decimal places
+func parseQValue(s string) (float64, bool) {
+	if len(s) == 0 || len(s) > 5 || s[0] != '0' && s[0] != '1' {
+		return 0, false
+	}
+	q, err := strconv.ParseFloat(s, 64)
+	return q, err == nil && q <= 1
+}
+
+// acceptEntry is the quality value and the position of an element in
+// Accept-Encoding
+type acceptEntry struct {
+	q   float64
+	pos int
+}
+
+/*
+checkAcceptEncoding picks the coding with the highest quality value in
+Accept-Encoding among the available codings, which map to their preference,
+following RFC 9110:
+
+  - The wildcard "*" matches all codings that are not listed explicitly.
+  - Codings with a quality value of 0 are not acceptable.
+  - On equal quality values the coding with the higher preference wins,
+    otherwise the one listed first.
+  - identity is returned as compNone. It only wins with a higher quality
+    value or if it's listed first.
+
+The result is not acceptable, if the client refuses identity, either
+explicitly or via the wildcard, and no other coding is available.
+*/
+func checkAcceptEncoding(hdr http.Header, available map[compType]int) (comp compType, acceptable bool) {
+	listed := make(map[string]acceptEntry)
+	for i, enc := range splitHeaderList(hdr, hdrAcceptEncoding) {
+		e, q, ok := parseCoding(enc)
+		if _, dup := listed[e]; ok && !dup {
+			listed[e] = acceptEntry{q, i}
+		}
+	}
+	lookup := func(coding string) (acceptEntry, bool) {
+		if entry, ok := listed[coding]; ok {
+			return entry, true
+		}
+		entry, ok := listed["*"]
+		return entry, ok
+	}
+
+	comp = compNone
+	var best acceptEntry
+	var bestPref int
+	for _, c := range byPreference(available) {
+		entry, ok := lookup(string(c))
+		if !ok || entry.q <= 0 {
+			continue
+		}
+		pref := available[c]
+		if comp == compNone ||
+			entry.q > best.q ||
+			entry.q == best.q && pref == bestPref && entry.pos < best.pos {
+			comp, best, bestPref = c, entry, pref
+		}
+	}
+
+	identity, ok := lookup(hdrContentEncodingIdentity)
+	if !ok {
+		// identity is always acceptable, unless refused
+		return comp, true
+	}
+	if comp != compNone && (identity.q > best.q || identity.q == best.q && identity.pos < best.pos) {
+		comp = compNone
+	}
+	return comp, comp != compNone || identity.q > 0
+}
+
+/*
+Negotiate chooses the content coding for the response to r among the
+supported ones, listed in order of preference of the server, following the
+rules of the middleware. It returns "identity" if the content should be sent
+unencoded. ok is false if the client refuses all supported codings as well as
+identity, which should be answered with 406 Not Acceptable:
+
+	switch enc, ok := compress.Negotiate(r, "br", "gzip"); {
+	case !ok:
+		http.Error(w, "not acceptable", http.StatusNotAcceptable)
+	case enc == "br":
+		serveBlob(w, r, key+".br")
+	...
+	}
+*/
+func Negotiate(r *http.Request, supported ...string) (encoding string, ok bool) {
+	available := make(map[compType]int, len(supported))
+	for i, coding := range supported {
+		c := toCompType(coding)
+		if _, dup := available[c]; !dup && c != hdrContentEncodingIdentity {
+			available[c] = len(supported) - i
+		}
+	}
+	comp, ok := checkAcceptEncoding(r.Header, available)
+	if comp == compNone {
+		return hdrContentEncodingIdentity, ok
+	}
+	return comp.String(), ok
+}
+
+// byPreference returns the codings in descending order of preference. Codings
+// with the same preference are sorted by name.
+func byPreference(available map[compType]int) []compType {
+	sorted := make([]compType, 0, len(available))
+	for c := range available {
+		sorted = append(sorted, c)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		pi, pj := available[sorted[i]], available[sorted[j]]
+		return pi > pj || pi == pj && sorted[i] < sorted[j]
+	})
+	return sorted
+}
+
+// writerPoolKey distinguishes the settings of pooled gzip and flate writers
+type writerPoolKey struct {
+	c     compType
+	level int
+}
+
+// writerPools keeps a *sync.Pool of gzip.Writers or flate.Writers per
+// writerPoolKey
+var writerPools sync.Map
+
+func writerPool(c compType, level int) *sync.Pool {
+	p, _ := writerPools.LoadOrStore(writerPoolKey{c, level}, new(sync.Pool))
+	return p.(*sync.Pool)
+}
+
+// newGzipWriter creates a gzip compressor, reusing a pooled writer if
+// possible. Every call gets its own gzipWriter, so closing it twice can't
+// release a writer that is in use again.
+func newGzipWriter(w io.Writer, level int) (WriteCloseFlusher, error) {
+	pool := writerPool(compGzip, level)
+	if gw, ok := pool.Get().(*gzip.Writer); ok {
+		gw.Reset(w)
+		return &gzipWriter{Writer: gw, pool: pool}, nil
+	}
+	gw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipWriter{Writer: gw, pool: pool}, nil
+}
+
+// newFlateWriter creates a deflate compressor, reusing a pooled writer if
+// possible. See newGzipWriter.
+func newFlateWriter(w io.Writer, level int) (WriteCloseFlusher, error) {
+	pool := writerPool(compDeflate, level)
+	if fw, ok := pool.Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return &flateWriter{Writer: fw, w: w, pool: pool}, nil
+	}
+	fw, err := flate.NewWriter(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &flateWriter{Writer: fw, w: w, pool: pool}, nil
+}
+
+// newBrotliWriter creates a brotli compressor. Levels outside of the brotli
+// range, like flate.DefaultCompression, select the default level.
+func newBrotliWriter(w io.Writer, level int) (WriteCloseFlusher, error) {
+	if level < brotli.BestSpeed || level > brotli.BestCompression {
+		level = brotli.DefaultCompression
+	}
+	return brotli.NewWriterLevel(w, level), nil
+}
+
+// zstdWriter returns the zstd.Encoder to its pool on the first Close
+type zstdWriter struct {
+	*zstd.Encoder
+	pool *sync.Pool
+
+	closed bool
+	err    error // result of Close
+}
+
+func (z *zstdWriter) Write(p []byte) (int, error) {
+	if z.closed {
+		return 0, errWriterClosed
+	}
+	return z.Encoder.Write(p)
+}
+
+func (z *zstdWriter) Flush() error {
+	if z.closed {
+		return errWriterClosed
+	}
+	return z.Encoder.Flush()
+}
+
+func (z *zstdWriter) Close() error {
+	if z.closed {
+		return z.err
+	}
+	z.closed = true
+	z.err = z.Encoder.Close()
+	if z.err == nil {
+		z.Reset(nil)
+		z.pool.Put(z.Encoder)
+	}
+	return z.err
+}
+
+// zstdPoolKey distinguishes the settings of pooled zstd.Encoders
+type zstdPoolKey struct {
+	level  zstd.EncoderLevel
+	window int
+}
+
+// zstdPools keeps a *sync.Pool of zstd.Encoders per zstdPoolKey
+var zstdPools sync.Map
+
+// newZstdWriter creates a zstd compressor with the default window size.
+func newZstdWriter(w io.Writer, level int) (WriteCloseFlusher, error) {
+	return newZstdWriterWindow(w, level, 0)
+}
+
+// newZstdWriterWindow creates a zstd compressor, reusing a pooled encoder if
+// possible. Levels outside of the zstd range, like flate.DefaultCompression,
+// select the default level. A window size of 0 selects the default.
+func newZstdWriterWindow(w io.Writer, level int, window int) (WriteCloseFlusher, error) {
+	key := zstdPoolKey{zstd.SpeedDefault, window}
+	if level >= 1 && level <= 22 {
+		key.level = zstd.EncoderLevelFromZstd(level)
+	}
+	p, _ := zstdPools.LoadOrStore(key, new(sync.Pool))
+	pool := p.(*sync.Pool)
+
+	if enc, ok := pool.Get().(*zstd.Encoder); ok {
+		enc.Reset(w)
+		return &zstdWriter{Encoder: enc, pool: pool}, nil
+	}
+
+	opts := []zstd.EOption{
+		zstd.WithEncoderLevel(key.level),
+		zstd.WithEncoderConcurrency(1),
+	}
+	if window != 0 {
+		opts = append(opts, zstd.WithWindowSize(window))
+	}
+	enc, err := zstd.NewWriter(w, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdWriter{Encoder: enc, pool: pool}, nil
+}
+
+// getCompressor opens a compressor of type c. The preset dictionary dict is
+// only used by the built-in deflate compressor and may be nil.
+func getCompressor(c compType, w io.Writer, level int, dict []byte) (WriteCloseFlusher, error) {
+	var comp WriteCloseFlusher
+	var err error
+	if rc, ok := lookupCoding(c); !ok {
+		err = errors.New("Unknown compressor type")
+	} else if c == compDeflate && dict != nil && rc.builtin {
+		comp, err = flate.NewWriterDict(w, level, dict)
+	} else {
+		comp, err = rc.factory(w, level)
+	}
+	return comp, errors.Wrap(err, "Opening compressor failed")
+}
+
+/*
+NewWriter creates a compressor for any of the registered codings, that writes
+to w. Compressors of the built-in codings are pooled and reused after Close.
+flate.DefaultCompression selects the same levels as the middleware does.
+
+	zw, err := compress.NewWriter(f, "zstd", flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, src); err != nil {
+		return err
+	}
+	return zw.Close()
+*/
+func NewWriter(w io.Writer, encoding string, level int) (WriteCloseFlusher, error) {
+	c := toCompType(encoding)
+	return getCompressor(c, w, (&config{level: level}).levelFor(c), nil)
+}
+
+/*******\
+* Utils *
+\*******/
+
+// isHTTP10 reports whether the request was made with HTTP/1.0, which doesn't
+// know chunked transfer coding
+func isHTTP10(r *http.Request) bool {
+	return r.ProtoMajor == 1 && r.ProtoMinor == 0
+}
+
+// isUpgrade reports whether the client asks to switch protocols, e.g. to
+// WebSockets
+func isUpgrade(r *http.Request) bool {
+	return hasDirective(r.Header, hdrConnection, "upgrade") && checkHeaderHas(r.Header, hdrUpgrade)
+}
+
+// Entropy sniffing settings. Text has an entropy of about 4 to 5 bits per
+// byte, compressed or encrypted data close to 8. The estimate for short
+// samples is too low, so they are not checked at all.
+const (
+	entropyMinSample = 512
+	entropyMaxSample = 4096
+	entropyThreshold = 7.5
+)
+
+// entropy estimates the Shannon entropy of p in bits per byte
+func entropy(p []byte) float64 {
+	var counts [256]int
+	for _, b := range p {
+		counts[b]++
+	}
+	var e float64
+	n := float64(len(p))
+	for _, c := range counts {
+		if c > 0 {
+			f := float64(c) / n
+			e -= f * math.Log2(f)
+		}
+	}
+	return e
+}
+
+// randomPadding returns a gzip extra field of random length up to max bytes,
+// which hides the exact length of the compressed content. The length has to
+// be unpredictable, so it comes from crypto/rand.
+func randomPadding(max int) []byte {
+	r, err := rand.Int(rand.Reader, big.NewInt(int64(max)+1))
+	if err != nil {
+		panic(errors.Wrap(err, "Reading random padding length failed"))
+	}
+	n := int(r.Int64())
+	if n > 0xffff-4 {
+		n = 0xffff - 4
+	}
+	// A single subfield with ID "Pd" followed by its length and the padding
+	extra := make([]byte, 4+n)
+	extra[0], extra[1] = 'P', 'd'
+	binary.LittleEndian.PutUint16(extra[2:], uint16(n))
+	return extra
+}
+
+// isSensitive reports whether the response to r likely contains secrets,
+// which make compression prone to BREACH
+func isSensitive(r *http.Request, hdr http.Header) bool {
+	return checkHeaderHas(hdr, hdrSetCookie) || checkHeaderHas(r.Header, hdrAuthorization)
+}
+
+func checkHeaderHas(hdr http.Header, key string) bool {
+	return hdr.Get(key) != ""
+}
+func getContentLength(hdr http.Header) int {
+	clength, _ := strconv.Atoi(hdr.Get(hdrContentLength))
+	return clength
+}
+
+// hasContentCoding reports whether any coding other than identity is applied
+// according to the, possibly multi-valued, Content-Encoding
+func hasContentCoding(hdr http.Header) bool {
+	for _, coding := range splitHeaderList(hdr, hdrContentEncoding) {
+		if !strings.EqualFold(coding, hdrContentEncodingIdentity) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBodylessStatus reports whether responses with status code never carry a
+// body
+func isBodylessStatus(code int) bool {
+	return code >= 100 && code < 200 || code == http.StatusNoContent || code == http.StatusNotModified
+}
+
+// hasTrailers reports whether trailers are declared or already set via
+// http.TrailerPrefix
+func hasTrailers(hdr http.Header) bool {
+	if checkHeaderHas(hdr, hdrTrailer) {
+		return true
+	}
+	for key := range hdr {
+		if strings.HasPrefix(key, http.TrailerPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitHeaderList returns the trimmed elements of the comma separated lists
+// in all values of hdr[key]. Empty elements are skipped.
+func splitHeaderList(hdr http.Header, key string) []string {
+	var list []string
+	for _, v := range hdr[http.CanonicalHeaderKey(key)] {
+		for _, elem := range strings.Split(v, ",") {
+			if elem = strings.TrimSpace(elem); elem != "" {
+				list = append(list, elem)
+			}
+		}
+	}
+	return list
+}
+
+// addVary merges field into the Vary header, keeping the fields set by the
+// handler and dropping duplicates. "Vary: *" already covers everything.
+func addVary(hdr http.Header, field string) {
+	var fields []string
+	seen := make(map[string]bool)
+	for _, f := range append(splitHeaderList(hdr, hdrVary), field) {
+		key := http.CanonicalHeaderKey(f)
+		if key == "*" {
+			hdr.Set(hdrVary, "*")
+			return
+		}
+		if !seen[key] {
+			seen[key] = true
+			fields = append(fields, f)
+		}
+	}
+	hdr.Set(hdrVary, strings.Join(fields, ", "))
+}
+
+// adjustETag changes the entity tag of a response compressed with coding c
+// according to mode
+func adjustETag(etag string, mode ETagMode, c compType) string {
+	weak := strings.HasPrefix(etag, "W/")
+	opaque := strings.TrimPrefix(etag, "W/")
+	switch {
+	case mode == ETagWeaken && !weak:
+		return "W/" + opaque
+	case mode == ETagSuffix && len(opaque) >= 2 && strings.HasSuffix(opaque, `"`):
+		return etag[:len(etag)-1] + "-" + c.String() + `"`
+	}
+	return etag
+}
+
+// stripETagSuffix removes the suffix ETagSuffix adds for coding c from the
+// entity tags in hdr[key], so the handler compares them with its own ETag
+func stripETagSuffix(hdr http.Header, key string, c compType) {
+	tags := splitHeaderList(hdr, key)
+	if len(tags) == 0 {
+		return
+	}
+	suffix := "-" + c.String() + `"`
+	for i, tag := range tags {
+		if strings.HasSuffix(tag, suffix) {
+			tags[i] = strings.TrimSuffix(tag, suffix) + `"`
+		}
+	}
+	hdr.Set(key, strings.Join(tags, ", "))
+}
+
+// hasDirective reports whether the directive is present in the comma
+// separated list of hdr[key], e.g. Cache-Control. Arguments of directives
+// are ignored.
+func hasDirective(hdr http.Header, key, directive string) bool {
+	for _, d := range splitHeaderList(hdr, key) {
+		name := strings.TrimSpace(strings.SplitN(d, "=", 2)[0])
+		if strings.EqualFold(name, directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripPreference removes the preference pref from the Prefer header and
+// reports whether it was present
+func stripPreference(hdr http.Header, pref string) bool {
+	var found bool
+	var rest []string
+	for _, p := range splitHeaderList(hdr, hdrPrefer) {
+		name := strings.TrimSpace(strings.SplitN(p, ";", 2)[0])
+		if strings.EqualFold(name, pref) {
+			found = true
+			continue
+		}
+		rest = append(rest, p)
+	}
+	if !found {
+		return false
+	}
+	if len(rest) == 0 {
+		hdr.Del(hdrPrefer)
+	} else {
+		hdr.Set(hdrPrefer, strings.Join(rest, ", "))
+	}
+	return true
+}
+
+// getMediaType returns the lower case media type of the Content-Type without
+// any parameters like charset, or "" if it can't be parsed. All matching of
+// types has to be done on the result of this function.
+func getMediaType(hdr http.Header) string {
+	mtype, _, err := mime.ParseMediaType(hdr.Get(hdrContentType))
+	if err != nil && err != mime.ErrInvalidMediaParameter {
+		return ""
+	}
+	return mtype
+}
+
+// matchMediaType reports whether mtype matches pattern, which is either a
+// media type, of the form "type/*" to match all subtypes, "*/*" to match
+// everything or a glob pattern like "application/*+json", see path.Match.
+func matchMediaType(pattern, mtype string) bool {
+	pattern = strings.ToLower(pattern)
+	if pattern == "*/*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mtype, pattern[:len(pattern)-1])
+	}
+	if matched, err := path.Match(pattern, mtype); err == nil {
+		return matched
+	}
+	return pattern == mtype
+}
+
+// matchMediaTypes reports whether mtype matches any of the patterns
+func matchMediaTypes(patterns []string, mtype string) bool {
+	for _, pattern := range patterns {
+		if matchMediaType(pattern, mtype) {
+			return true
+		}
+	}
+	return false
+}
+
+// mimeOctetStream is the media type of arbitrary binary data
+const mimeOctetStream = "application/octet-stream"
+
+// List of Mimetypes that is likely to be compressable. WebAssembly, TrueType
+// and OpenType fonts as well as icons compress very well. Other fonts like
+// font/woff and font/woff2 are deliberately missing, as they are compressed
+// already.
+var compressableTypes = []string{
+	"text/*",
+	"image/svg+xml",
+	"image/x-icon",
+	"image/vnd.microsoft.icon",
+	"image/bmp",
+	"application/javascript",
+	"application/x-javascript",
+	"application/ecmascript",
+	"application/json",
+	"application/x-ndjson",
+	"application/*+json",
+	"application/xml",
+	"application/*+xml",
+	"application/wasm",
+	"application/vnd.ms-fontobject",
+	"font/ttf",
+	"font/otf",
+}
+
+// isCompressableType checks the Content-Type against the configured lists of
+// types. The denylist takes precedence.
+func isCompressableType(cfg *config, hdr http.Header) bool {
+	mtype := getMediaType(hdr)
+	if matchMediaTypes(cfg.excludedTypes, mtype) {
+		return false
+	}
+	if cfg.types != nil {
+		return matchMediaTypes(cfg.types, mtype)
+	}
+	return matchMediaTypes(compressableTypes, mtype)
+}
+
+// hasCompressableLength checks the announced Content-Length. Without one, the
+// decision is postponed until the content is buffered, see closeBuffered.
+func hasCompressableLength(cfg *config, hdr http.Header) bool {
+	if !checkHeaderHas(hdr, hdrContentLength) {
+		return true
+	}
+	return getContentLength(hdr) >= cfg.minLength && // Don't compress too small files, too much overhead TODO: find good MinBuffer
+		getContentLength(hdr) > 0 // Never compress empty files, even if the minimum length is 0
+}
+
+// skipReason checks the status and header of a response and returns why it is
+// not compressed or "" if it is compressable
+func skipReason(cfg *config, code int, hdr http.Header) string {
+	switch {
+	case isBodylessStatus(code) || !cfg.compressStatus(code): // Nothing to compress or not wanted
+		return SkipStatus
+	case code == http.StatusPartialContent || checkHeaderHas(hdr, hdrContentRange): // Ranges refer to the uncompressed content
+		return SkipRange
+	case !hasCompressableLength(cfg, hdr):
+		return SkipLength
+	case hasContentCoding(hdr): // Don't compress more than once
+		return SkipEncoded
+	case !cfg.ignoreNoTransform && hasDirective(hdr, hdrCacheControl, hdrCacheControlNoTransform): // RFC 9111 5.2.2.6
+		return SkipNoTransform
+	case !isCompressableType(cfg, hdr) && // Check if Content is likely to be compressable
+		!(cfg.sniffEntropy && getMediaType(hdr) == mimeOctetStream) && // Decide by looking at the content
+		!(cfg.compressIfContentLanguage && checkHeaderHas(hdr, hdrContentLanguage)): // Localized content is text
+		return SkipType
+	}
+	return ""
+}
+
+/************************\
+* compressResponseWriter *
+\************************/
+
+// Writer is implemented by the http.ResponseWriter that the middleware passes
+// to the wrapped handler. Handlers and middlewares in between can type assert
+// to it to find out about the compression of the response.
+type Writer interface {
+	http.ResponseWriter
+	// Coding returns the coding negotiated with the client.
+	Coding() string
+	// Compressed reports whether the response is sent compressed. Buffered
+	// responses are only compressed when the wrapped handler returns.
+	Compressed() bool
+	// Status returns the status code set by the handler, or 0 if it hasn't
+	// been set yet. It is available before the header is actually sent.
+	Status() int
+	// UncompressedSize returns the number of bytes written by the handler.
+	UncompressedSize() int
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter                   // underlying network connection
+	z                   WriteCloseFlusher // the compressor
+	buf                 *bytes.Buffer     // buffered content, as long as it fits into the buffer size
+
+	// the writer everything is written to, either the ResponseWriter,
+	// the buffer or the compressor
+	w io.Writer
+
+	// which compressor to choose and how to configure it
+	c   compType
+	cfg *config
+	r   *http.Request // the request being answered
+
+	digest hash.Hash // checksum of the compressed content, if requested
+	magic  []byte    // expected start of content that is encoded by the handler
+
+	cacheKey  cacheKey // key to store the compressed content under, if cacheable
+	cacheable bool     // set when the response may be stored in the cache
+	cached    []byte   // compressed content from the cache, until it is sent
+	cacheHit  bool     // set when the content of the handler is discarded
+	head      bool     // set when answering a HEAD request, discarding the content
+
+	written int64 // number of uncompressed bytes written by the handler
+	flushed int64 // value of written at the last flush
+	sent    int64 // number of compressed bytes sent
+
+	compressTime time.Duration // time spent in the compressor
+	skipped      string        // why the response isn't compressed
+	buffered     bool          // set when the response was sent with a Content-Length
+	active       bool          // set when counted in cfg.active
+	slot         bool          // set when holding one of cfg.slots
+	level        int           // the compression level used
+
+	file     *os.File // compressed content beyond the buffer size, see WithSpillToDisk
+	fileSize int64    // size of file
+
+	flushEachWrite bool // set for event streams, that must not be delayed
+	holding        bool // set when buffering only until minLength, then streaming
+
+	code int   // save code for when to write out buffered content
+	err  error // last occurred error
+
+	wroteHeader bool // keep track whether header was written (see http.ResponseWriter)
+	isBuffered  bool // set when buffering uncompressed content
+	isZBuffered bool // set when buffering compressed content
+	compressed  bool // set when the headers announce compression
+	closed      bool // set when Close was called
+	hijacked    bool // set when the handler took over the connection
+	sniffing    bool // set while collecting content to detect its type
+	skip        bool // set when the handler asked for no compression
+}
+
+// crwPool keeps compressResponseWriters for reuse to save allocations
+var crwPool = sync.Pool{
+	New: func() interface{} {
+		return new(compressResponseWriter)
+	},
+}
+
+func newCompressResponseWriter(r *http.Request, w http.ResponseWriter, c compType, cfg *config) *compressResponseWriter {
+	crw := crwPool.Get().(*compressResponseWriter)
+	crw.Reset(w, c, cfg)
+	crw.r = r
+	return crw
+}
+
+// Reset discards all state of crw and reinitializes it to write to w.
+func (crw *compressResponseWriter) Reset(w http.ResponseWriter, c compType, cfg *config) {
+	*crw = compressResponseWriter{ResponseWriter: w,
+		c:   c,
+		cfg: cfg}
+}
+
+// release puts crw back into the pool. It must not be used afterwards and
+// must only be called after Close.
+func (crw *compressResponseWriter) release() {
+	if crw.active {
+		crw.cfg.active.Add(-1)
+		crw.active = false
+	}
+	if crw.slot {
+		<-crw.cfg.slots
+		crw.slot = false
+	}
+	crw.removeFile()
+	if crw.buf != nil {
+		// Close failed to drain the buffer, don't keep the response around
+		return
+	}
+	crw.Reset(nil, compNone, nil)
+	crwPool.Put(crw)
+}
+
+// bufPool keeps the buffers for buffered responses
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer empties b and puts it back into the pool, unless it grew too
+// large to keep it around compared to the buffer size maxBuf.
+func putBuffer(b *bytes.Buffer, maxBuf int) {
+	if b.Cap() > 2*maxBuf {
+		return
+	}
+	b.Reset()
+	bufPool.Put(b)
+}
+
+// releaseBuffer gives up the buffer after its content was sent
+func (crw *compressResponseWriter) releaseBuffer() {
+	if crw.buf.Len() != 0 {
+		return
+	}
+	putBuffer(crw.buf, crw.cfg.maxBuf)
+	crw.buf = nil
+}
+
+// Writing of the header needs to be delayed until either the buffer
+// overflows or Close() is called. Only then we know the Content-Length.
+func (crw *compressResponseWriter) WriteHeader(code int) {
+	if crw.hijacked {
+		crw.cfg.logger.Printf("compress: WriteHeader call with code %d on hijacked connection", code)
+		return
+	}
+	if crw.wroteHeader {
+		// Even if the header is still buffered, the decision about
+		// compression is based on it already. Behave like net/http.
+		if crw.written > 0 {
+			crw.cfg.logger.Printf("compress: WriteHeader call with code %d after Write, keeping %d", code, crw.code)
+		} else {
+			crw.cfg.logger.Printf("compress: superfluous WriteHeader call with code %d, keeping %d", code, crw.code)
+		}
+		return
+	}
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		// Interim responses like 103 Early Hints precede the final one
+		crw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	crw.wroteHeader = true
+
+	crw.w = crw.ResponseWriter
+	crw.code = code
+
+	if isBodylessStatus(code) {
+		// Nothing to compress, so the header goes out unchanged right away
+		crw.skipped = SkipStatus
+		if code == http.StatusNotModified {
+			// A 304 stands in for the compressed response the client
+			// has cached, so it carries the same Vary and ETag, see
+			// RFC 9110, section 15.4.5
+			hdr := crw.Header()
+			addVary(hdr, hdrAcceptEncoding)
+			if etag := hdr.Get(hdrETag); etag != "" {
+				hdr.Set(hdrETag, adjustETag(etag, crw.cfg.etagMode, crw.c))
+			}
+		}
+		crw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if _, ok := crw.Header()[hdrContentType]; !ok {
+		// Like net/http, look at the content to find its type, which is
+		// needed to decide about compression
+		crw.sniffing = true
+		crw.buf = getBuffer()
+		crw.w = crw.buf
+		return
+	}
+	crw.decide()
+}
+
+// checkSkip returns why the response is not compressed or "" if it is
+func (crw *compressResponseWriter) checkSkip() string {
+	if crw.skip {
+		return SkipHandler
+	}
+	if reason := skipReason(crw.cfg, crw.code, crw.Header()); reason != "" {
+		return reason
+	}
+	switch {
+	case crw.cfg.skipSensitive && isSensitive(crw.r, crw.Header()):
+		return SkipSensitive
+	case crw.cfg.shouldCompress != nil && !crw.cfg.shouldCompress(crw.code, crw.Header(), crw.r):
+		return SkipPredicate
+	case crw.cfg.isOverloaded():
+		return SkipOverloaded
+	}
+	return ""
+}
+
+// acquireSlot reserves one of the slots of WithMaxConcurrent, waiting for as
+// long as configured. It reports false if none became available.
+func (crw *compressResponseWriter) acquireSlot() bool {
+	if crw.cfg.slots == nil {
+		return true
+	}
+	select {
+	case crw.cfg.slots <- struct{}{}:
+		crw.slot = true
+		return true
+	default:
+	}
+	if crw.cfg.concurrentWait <= 0 {
+		return false
+	}
+	t := time.NewTimer(crw.cfg.concurrentWait)
+	defer t.Stop()
+	select {
+	case crw.cfg.slots <- struct{}{}:
+		crw.slot = true
+		return true
+	case <-t.C:
+	case <-crw.r.Context().Done():
+	}
+	return false
+}
+
+// sendHead answers a HEAD request with the header a GET request would get,
+// without running the compressor. The Content-Length of the compressed
+// content is only known if it is in the cache. The body written by the
+// handler is discarded.
+func (crw *compressResponseWriter) sendHead() {
+	var size = -1
+	if crw.cfg.cache != nil {
+		if key, ok := responseCacheKey(crw.r, crw.c, crw.code, crw.Header()); ok {
+			if body, hit := crw.cfg.cache.get(key); hit {
+				size = len(body)
+			}
+		}
+	}
+	crw.head = true
+	crw.w = io.Discard
+	if crw.buf != nil {
+		crw.buf.Reset()
+		crw.releaseBuffer()
+	}
+	crw.setCompressionHeaders()
+	if size >= 0 {
+		crw.Header().Set(hdrContentLength, strconv.Itoa(size))
+	}
+	crw.setDebugHeaders(-1)
+	crw.ResponseWriter.WriteHeader(crw.code)
+}
+
+// decide chooses between passing the content through, streaming or buffering
+// it, once the header is complete
+func (crw *compressResponseWriter) decide() {
+	code := crw.code
+	crw.skipped = crw.checkSkip()
+	if crw.skipped == "" && crw.r.Method == http.MethodHead {
+		crw.sendHead()
+		return
+	}
+	if crw.skipped == "" && !crw.acquireSlot() {
+		crw.skipped = SkipOverloaded
+	}
+	if crw.skipped != "" {
+		if crw.cfg.strictEncoding {
+			// The handler claims to have encoded the content already
+			crw.magic = compMagic[toCompType(crw.Header().Get(hdrContentEncoding))]
+		}
+		if crw.buf != nil && len(crw.magic) > 0 {
+			if crw.err = crw.checkMagic(crw.buf.Bytes()); crw.err != nil {
+				crw.cfg.logger.Printf("%v", crw.err)
+				return
+			}
+		}
+		crw.sendUncompressed()
+		return
+	}
+	if crw.cfg.countsActive() {
+		crw.cfg.active.Add(1)
+		crw.active = true
+	}
+
+	if crw.cfg.digestTrailer {
+		crw.digest = sha256.New()
+		crw.Header().Add(hdrTrailer, hdrDigest)
+	}
+
+	// Event streams must not be delayed at all
+	crw.flushEachWrite = matchMediaTypes(crw.cfg.flushTypes, getMediaType(crw.Header()))
+	if crw.flushEachWrite {
+		crw.startStreaming()
+		return
+	}
+
+	// Trailers can only be sent after a chunked body and handlers setting
+	// Transfer-Encoding want chunking anyway, so there is no point in
+	// buffering to find the Content-Length. Only hold the content until it
+	// is long enough to be worth compressing.
+	if crw.cfg.noBuffering ||
+		hasTrailers(crw.Header()) ||
+		checkHeaderHas(crw.Header(), hdrTransferEncoding) {
+		crw.holding = true
+		crw.startBuffering()
+		return
+	}
+
+	if crw.cfg.cache != nil {
+		if key, ok := responseCacheKey(crw.r, crw.c, code, crw.Header()); ok {
+			if body, hit := crw.cfg.cache.get(key); hit {
+				// Same representation, so the content of the handler
+				// is not needed
+				crw.cached, crw.cacheHit = body, true
+				crw.w = io.Discard
+				if crw.buf != nil {
+					crw.buf.Reset()
+					crw.releaseBuffer()
+				}
+				return
+			}
+			crw.cacheKey, crw.cacheable = key, true
+		}
+	}
+
+	// Regardless of the announced Content-Length, start buffering. If the
+	// content turns out to be too large, switch to on-the-fly compression.
+	crw.startBuffering()
+}
+
+// startBuffering collects the uncompressed content in the buffer
+func (crw *compressResponseWriter) startBuffering() {
+	if crw.buf == nil {
+		crw.buf = getBuffer()
+	}
+	crw.w = crw.buf
+	crw.isBuffered = true
+}
+
+// bufferLimit is the amount of uncompressed content buffered before the
+// compressor has to start. Held content is streamed as soon as it reaches
+// minLength.
+func (crw *compressResponseWriter) bufferLimit() int {
+	if !crw.holding {
+		return crw.cfg.bufferThreshold()
+	}
+	if crw.cfg.minLength > 1 {
+		return crw.cfg.minLength - 1
+	}
+	return 0
+}
+
+// sniffLen is the amount of content http.DetectContentType looks at
+const sniffLen = 512
+
+// sniffType sets the Content-Type detected from the buffered content followed
+// by next and decides about compression
+func (crw *compressResponseWriter) sniffType(next []byte) {
+	crw.sniffing = false
+	sample := crw.buf.Bytes()
+	if missing := sniffLen - len(sample); missing > 0 {
+		if len(next) > missing {
+			next = next[:missing]
+		}
+		sample = append(sample[:len(sample):len(sample)], next...)
+	}
+	if len(sample) > 0 {
+		crw.Header().Set(hdrContentType, http.DetectContentType(sample))
+	}
+	crw.decide()
+}
+
+// checkMagic verifies that the content written so far starts with the
+// remaining magic bytes
+func (crw *compressResponseWriter) checkMagic(p []byte) error {
+	n := len(crw.magic)
+	if len(p) < n {
+		n = len(p)
+	}
+	if !bytes.Equal(p[:n], crw.magic[:n]) {
+		return errors.Errorf("Content doesn't match announced Content-Encoding %q", crw.Header().Get(hdrContentEncoding))
+	}
+	crw.magic = crw.magic[n:]
+	return nil
+}
+
+// setCompressionHeaders updates the headers to reflect the compressed content.
+// This is the only place where headers are changed for compression, which
+// keeps the following invariants:
+//   - uncompressed responses are left untouched
+//   - streamed responses have Content-Encoding and Vary, but no Content-Length
+//   - buffered responses additionally get the compressed Content-Length,
+//     which is set by the caller afterwards
+func (crw *compressResponseWriter) setCompressionHeaders() {
+	hdr := crw.Header()
+	if name := crw.cfg.originalLengthHeader; name != "" && checkHeaderHas(hdr, hdrContentLength) {
+		hdr.Set(name, hdr.Get(hdrContentLength))
+	}
+	if crw.cfg.debugHeaders && checkHeaderHas(hdr, hdrContentLength) {
+		hdr.Set(hdrXCompressOriginalLength, hdr.Get(hdrContentLength))
+	}
+	hdr.Del(hdrContentLength) // we don't know the compressed size beforehand
+	hdr.Set(hdrContentEncoding, crw.c.String())
+	addVary(hdr, hdrAcceptEncoding)
+	if crw.cfg.stripAcceptRanges {
+		hdr.Del(hdrAcceptRanges)
+	}
+	if etag := hdr.Get(hdrETag); etag != "" {
+		hdr.Set(hdrETag, adjustETag(etag, crw.cfg.etagMode, crw.c))
+	}
+	crw.compressed = true
+}
+
+// setDebugHeaders adds the headers of WithDebugHeaders right before the
+// header is written. size is the length of the compressed content, if it is
+// known, or -1.
+func (crw *compressResponseWriter) setDebugHeaders(size int) {
+	if !crw.cfg.debugHeaders {
+		return
+	}
+	hdr := crw.Header()
+	if !crw.compressed {
+		hdr.Set(hdrXCompressSkipped, crw.skipped)
+		return
+	}
+	encoder := crw.c.String() + "; level=" + strconv.Itoa(crw.level)
+	switch {
+	case crw.cacheHit:
+		encoder = crw.c.String() + "; cached"
+	case crw.level == flate.DefaultCompression:
+		encoder = crw.c.String() + "; level=default"
+	}
+	hdr.Set(hdrXCompressEncoder, encoder)
+	if size < 0 || crw.written == 0 {
+		return
+	}
+	hdr.Set(hdrXCompressOriginalLength, strconv.FormatInt(crw.written, 10))
+	hdr.Set(hdrXCompressRatio, strconv.FormatFloat(float64(size)/float64(crw.written), 'f', 3, 64))
+}
+
+// addServerTiming reports the time spent compressing under key, if enabled by
+// WithServerTiming
+func (crw *compressResponseWriter) addServerTiming(key string) {
+	if !crw.cfg.serverTiming || !crw.compressed {
+		return
+	}
+	dur := strconv.FormatFloat(float64(crw.compressTime)/float64(time.Millisecond), 'f', 3, 64)
+	crw.Header().Add(key, "compress;dur="+dur+`;desc="`+crw.c.String()+`"`)
+}
 
-/**************************************\
-* Fused gzip + deflate compressor type *
-\**************************************/
+// Coding implements Writer
+func (crw *compressResponseWriter) Coding() string {
+	return crw.c.String()
+}
 
-type writeCloseFlusher interface {
-	io.WriteCloser
-	Flush() error
+// Compressed implements Writer
+func (crw *compressResponseWriter) Compressed() bool {
+	return crw.compressed
 }
 
-type compType int
+// Status implements Writer
+func (crw *compressResponseWriter) Status() int {
+	return crw.code
+}
 
-const (
-	compNone = compType(iota)
-	compGzip
-	compDeflate
-)
+// UncompressedSize implements Writer
+func (crw *compressResponseWriter) UncompressedSize() int {
+	return int(crw.written)
+}
 
-var (
-	compStrings = [...]string{
-		"none",
-		hdrContentEncodingGzip,
-		hdrContentEncodingDeflate,
+// startBufferedCompression commits to compression once the buffered
+// uncompressed content exceeds the threshold. The compressed content is
+// buffered until it exceeds the buffer size, see zBufferWriter.
+func (crw *compressResponseWriter) startBufferedCompression() error {
+	z, err := crw.getCompressor(zBufferWriter{crw}, -1)
+	if err != nil {
+		crw.cfg.logger.Printf("%v", err)
+		return crw.startStreaming()
 	}
-)
+	start := time.Now()
+	defer func() { crw.compressTime += time.Since(start) }()
+	crw.isBuffered = false
+	crw.isZBuffered = true
+	crw.z = z
+	crw.w = z
 
-func (c compType) String() string {
-	return compStrings[c]
+	raw := crw.buf
+	crw.buf = getBuffer()
+	if _, err = z.Write(raw.Bytes()); err != nil && crw.isZBuffered {
+		// Nothing was sent yet, so the original content can still be
+		// delivered
+		crw.cfg.logger.Printf("%v", errors.Wrap(err, "Compressing buffer failed"))
+		putBuffer(crw.buf, crw.cfg.maxBuf)
+		crw.buf = raw
+		crw.isZBuffered = false
+		crw.skipped = SkipError
+		return crw.sendUncompressed()
+	}
+	putBuffer(raw, crw.cfg.maxBuf)
+	crw.err = errors.Wrap(err, "Writing buffer in compressResponseWriter failed")
+	return crw.err
 }
 
-func checkAcceptEncoding(hdr http.Header) compType {
-	for _, enc := range strings.Split(hdr.Get(hdrAcceptEncoding), ",") {
-		e := strings.TrimSpace(enc)
-		for i, name := range compStrings {
-			if name == e {
-				return compType(i)
-			}
-		}
-	}
-	return compNone
+// zBufferWriter is the destination of the compressor during buffered
+// compression. Once the compressed content exceeds the buffer size, it is
+// spilled to the ResponseWriter.
+type zBufferWriter struct {
+	crw *compressResponseWriter
 }
 
-func getCompressor(c compType, w io.Writer, level int) (writeCloseFlusher, error) {
-	var comp writeCloseFlusher
-	var err error
-	switch c {
-	case compGzip:
-		comp, err = gzip.NewWriterLevel(w, level)
-	case compDeflate:
-		comp, err = flate.NewWriter(w, level)
-	default:
-		err = errors.New("Unknown compressor type")
+func (zw zBufferWriter) Write(p []byte) (int, error) {
+	crw := zw.crw
+	if crw.isZBuffered {
+		if crw.file == nil && (crw.buf.Len()+len(p) <= crw.cfg.maxBuf || crw.bufferAll()) {
+			return crw.buf.Write(p)
+		}
+		if crw.spillToFile(len(p)) {
+			return crw.writeFile(p)
+		}
+		if err := crw.spill(); err != nil {
+			return 0, err
+		}
 	}
-	return comp, errors.Wrap(err, "Opening compressor failed")
+	return sentWriter{crw}.Write(p)
 }
 
-/*******\
-* Utils *
-\*******/
+// bufferAll reports whether the compressed content is buffered completely, to
+// send it with a Content-Length, see HTTP10Buffer
+func (crw *compressResponseWriter) bufferAll() bool {
+	return crw.cfg.http10 == HTTP10Buffer && isHTTP10(crw.r)
+}
 
-func checkHeaderHas(hdr http.Header, key string) bool {
-	return hdr.Get(key) != ""
+// sentWriter writes to the ResponseWriter and counts the bytes sent
+type sentWriter struct {
+	crw *compressResponseWriter
 }
-func getContentLength(hdr http.Header) int {
-	clength, _ := strconv.Atoi(hdr.Get(hdrContentLength))
-	return clength
+
+func (sw sentWriter) Write(p []byte) (int, error) {
+	n, err := sw.crw.ResponseWriter.Write(p)
+	sw.crw.sent += int64(n)
+	return n, err
 }
 
-// List of Mimetypes that is likely to be compressable
-func isCompressableType(hdr http.Header) bool {
-	mtype := hdr.Get(hdrContentType)
-	if strings.HasPrefix(mtype, "text/") ||
-		strings.HasPrefix(mtype, "image/svg") ||
-		strings.HasPrefix(mtype, "application/javascript") ||
-		strings.HasPrefix(mtype, "application/x-javascript") {
-		return true
+// spill gives up on buffering compressed content and writes the header
+// without Content-Length followed by the buffer or the temporary file
+func (crw *compressResponseWriter) spill() error {
+	crw.isZBuffered = false
+	crw.setCompressionHeaders()
+	crw.setDebugHeaders(-1)
+	crw.ResponseWriter.WriteHeader(crw.code)
+	if crw.file != nil {
+		if err := crw.sendFile(); err != nil {
+			return err
+		}
 	}
-	return false
+	_, err := crw.buf.WriteTo(sentWriter{crw})
+	crw.releaseBuffer()
+	return err
 }
-func checkIsCompressable(code int, hdr http.Header) bool {
-	return code == http.StatusOK &&
-		getContentLength(hdr) >= CompressMinLength && // Don't compress too small files, too much overhead TODO: find good MinBuffer
-		!checkHeaderHas(hdr, hdrTrailer) && // Don't know how to handle Trailers, does it matter?
-		!checkHeaderHas(hdr, hdrContentEncoding) && // Don't compress more than once
-		isCompressableType(hdr) // Check if Content is likely to be compressable
+
+// looksCompressed reports whether entropy sniffing is enabled and the start of
+// the buffered content, followed by next, looks like it is compressed already
+func (crw *compressResponseWriter) looksCompressed(next []byte) bool {
+	if !crw.cfg.sniffEntropy || crw.buf == nil {
+		return false
+	}
+	sample := crw.buf.Bytes()
+	if len(sample) > entropyMaxSample {
+		sample = sample[:entropyMaxSample]
+	}
+	if missing := entropyMaxSample - len(sample); len(next) > missing {
+		next = next[:missing]
+	}
+	sample = append(sample[:len(sample):len(sample)], next...)
+	return len(sample) >= entropyMinSample && entropy(sample) > entropyThreshold
 }
 
-/************************\
-* compressResponseWriter *
-\************************/
+// getCompressor opens the compressor for the response writing to w. size is
+// the length of the content, if known, or -1.
+func (crw *compressResponseWriter) getCompressor(w io.Writer, size int) (WriteCloseFlusher, error) {
+	if size < 0 && checkHeaderHas(crw.Header(), hdrContentLength) {
+		size = getContentLength(crw.Header())
+	}
+	level := crw.cfg.levelForSize(crw.c, size)
+	if crw.cfg.nearDeadline(crw.r.Context()) || crw.cfg.isBusy() {
+		// No time to waste on expensive compression
+		level = flate.BestSpeed
+	}
+	crw.level = level
+	if crw.c == compGzip && crw.cfg.parallelGzip > 0 && size >= crw.cfg.parallelGzip && crw.cfg.padding == 0 {
+		osByte := byte(255) // unknown, like gzip.Writer
+		if crw.cfg.deterministicGzip {
+			osByte = 0
+		}
+		return newParallelGzipWriter(w, level, osByte), nil
+	}
+	z, err := crw.cfg.getCompressor(crw.c, w, level)
+	if gz, ok := z.(*gzipWriter); ok {
+		if crw.cfg.deterministicGzip {
+			// The modification time is unset already
+			gz.Header.OS = 0
+		}
+		if crw.cfg.padding > 0 {
+			gz.Header.Extra = randomPadding(crw.cfg.padding)
+		}
+	}
+	return z, err
+}
 
-type compressResponseWriter struct {
-	http.ResponseWriter                   // underlying network connection
-	z                   writeCloseFlusher // the compressor
-	buf                 bytes.Buffer      // buffer in case of a small enough file
+// dropDigest removes the Digest trailer announced in WriteHeader, as only
+// compressed content gets one
+func (crw *compressResponseWriter) dropDigest() {
+	if crw.digest == nil {
+		return
+	}
+	crw.digest = nil
 
-	// the writer everything is written to, either the ResponseWriter or compressor
-	w io.Writer
+	hdr := crw.Header()
+	var trailers []string
+	for _, t := range splitHeaderList(hdr, hdrTrailer) {
+		if !strings.EqualFold(t, hdrDigest) {
+			trailers = append(trailers, t)
+		}
+	}
+	hdr.Del(hdrTrailer)
+	if len(trailers) > 0 {
+		hdr.Set(hdrTrailer, strings.Join(trailers, ", "))
+	}
+}
 
-	// which compressor to choose and with what level
-	c     compType
-	level int
+// heldWriter is the destination of the compressor while streaming. Its output
+// is held back until the buffered content was compressed successfully, so it
+// can still be sent uncompressed otherwise.
+type heldWriter struct {
+	out  io.Writer
+	held *bytes.Buffer
+}
 
-	code int   // save code for when to write out buffered content
-	err  error // last occurred error
+func (hw *heldWriter) Write(p []byte) (int, error) {
+	if hw.held != nil {
+		return hw.held.Write(p)
+	}
+	return hw.out.Write(p)
+}
 
-	wroteHeader bool // keep track whether header was written (see http.ResponseWriter)
-	isBuffered  bool // set when using buffer
+// release writes the held back output and passes everything through from
+// now on
+func (hw *heldWriter) release(maxBuf int) error {
+	held := hw.held
+	hw.held = nil
+	_, err := held.WriteTo(hw.out)
+	putBuffer(held, maxBuf)
+	return err
 }
 
-func newCompressResponseWriter(w http.ResponseWriter, c compType, level int) *compressResponseWriter {
-	return &compressResponseWriter{ResponseWriter: w,
-		c:     c,
-		level: level}
+// startStreaming gives up on buffering. The header is written without
+// Content-Length and everything buffered so far is fed to the compressor,
+// which from now on writes directly to the ResponseWriter.
+func (crw *compressResponseWriter) startStreaming() error {
+	crw.isBuffered = false
+	var out io.Writer = sentWriter{crw}
+	if crw.digest != nil {
+		out = io.MultiWriter(out, crw.digest)
+	}
+	hw := &heldWriter{out: out, held: getBuffer()}
+	start := time.Now()
+	z, err := crw.getCompressor(hw, -1)
+	if err == nil && crw.buf != nil {
+		_, err = z.Write(crw.buf.Bytes())
+	}
+	crw.compressTime += time.Since(start)
+	if err != nil {
+		// Rather deliver the content uncompressed than not at all
+		crw.cfg.logger.Printf("%v", errors.Wrap(err, "Starting compression failed"))
+		putBuffer(hw.held, crw.cfg.maxBuf)
+		crw.skipped = SkipError
+		return crw.sendUncompressed()
+	}
+	if crw.buf != nil {
+		crw.buf.Reset()
+		crw.releaseBuffer()
+	}
+	crw.z = z
+	crw.w = z
+	crw.setCompressionHeaders()
+	crw.setDebugHeaders(-1)
+	crw.ResponseWriter.WriteHeader(crw.code)
+	crw.err = errors.Wrap(hw.release(crw.cfg.maxBuf), "Writing buffer in compressResponseWriter failed")
+	return crw.err
 }
 
-// Writing of the header needs to be delayed until Close()
-// Only then we know the Content-Length
-func (crw *compressResponseWriter) WriteHeader(code int) {
-	if crw.wroteHeader {
-		return
+// streamBuffered starts streaming the buffered content, unless it looks
+// compressed already
+func (crw *compressResponseWriter) streamBuffered() error {
+	if crw.looksCompressed(nil) {
+		crw.skipped = SkipEntropy
+		return crw.sendUncompressed()
 	}
-	crw.wroteHeader = true
+	return crw.startStreaming()
+}
 
+// sendUncompressed gives up on compression before anything was sent and
+// passes the buffered and all following content through as is
+func (crw *compressResponseWriter) sendUncompressed() error {
+	crw.isBuffered = false
+	crw.z = nil
 	crw.w = crw.ResponseWriter
-	hdr := crw.Header()
-
-	if checkIsCompressable(code, hdr) {
-		if getContentLength(hdr) < CompressMaxBuf {
-			crw.buf.Grow(CompressMaxBuf)
-			crw.w = &crw.buf
-			crw.code = code
-			crw.isBuffered = true
-		}
-		crw.z, crw.err = getCompressor(crw.c, crw.w, crw.level)
-		crw.w = crw.z
-
-		// Update Headers
-		hdr.Del(hdrContentLength) // we don't know the compressed size beforehand
-		hdr.Set(hdrContentEncoding, crw.c.String())
-		hdr.Set(hdrVary, hdrAcceptEncoding)
-	}
+	crw.dropDigest()
+	crw.setDebugHeaders(-1)
+	crw.ResponseWriter.WriteHeader(crw.code)
+	return crw.writeBuffered()
+}
 
-	if !crw.isBuffered {
-		crw.ResponseWriter.WriteHeader(code)
+// writeBuffered writes the buffered content to the current destination
+func (crw *compressResponseWriter) writeBuffered() error {
+	if crw.buf == nil {
+		return nil
 	}
+	_, crw.err = crw.buf.WriteTo(crw.w)
+	crw.releaseBuffer()
+	crw.err = errors.Wrap(crw.err, "Writing buffer in compressResponseWriter failed")
+	return crw.err
 }
 
 func (crw *compressResponseWriter) Write(p []byte) (int, error) {
+	if crw.hijacked {
+		return 0, http.ErrHijacked
+	}
 	if crw.err != nil {
 		return 0, crw.err
 	}
+	if crw.closed {
+		return 0, errors.New("Write after Close in compressResponseWriter")
+	}
 
 	if !crw.wroteHeader {
 		crw.WriteHeader(http.StatusOK)
 	}
 
+	if crw.sniffing {
+		if crw.buf.Len()+len(p) < sniffLen {
+			n, _ := crw.buf.Write(p)
+			crw.written += int64(n)
+			return n, nil
+		}
+		if crw.sniffType(p); crw.err != nil {
+			return 0, crw.err
+		}
+	}
+
+	if len(crw.magic) > 0 {
+		if crw.err = crw.checkMagic(p); crw.err != nil {
+			crw.cfg.logger.Printf("%v", crw.err)
+			return 0, crw.err
+		}
+	}
+
+	if crw.isBuffered && crw.buf.Len()+len(p) > crw.bufferLimit() {
+		var err error
+		if crw.looksCompressed(p) {
+			crw.skipped = SkipEntropy
+			err = crw.sendUncompressed()
+		} else if crw.holding {
+			err = crw.startStreaming()
+		} else if crw.cfg.bufferThreshold() < crw.cfg.maxBuf || crw.cfg.spillLimit > 0 || crw.bufferAll() {
+			err = crw.startBufferedCompression()
+		} else {
+			err = crw.startStreaming()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	var n int
 
+	start := time.Now()
 	n, crw.err = crw.w.Write(p)
+	if crw.z != nil {
+		crw.compressTime += time.Since(start)
+	}
 	crw.err = errors.Wrap(crw.err, "Write in compressResponseWriter failed")
+	crw.written += int64(n)
+
+	if crw.err == nil && crw.z != nil {
+		crw.flush(crw.flushMode())
+	}
 
 	return n, crw.err
 }
 
 func (crw *compressResponseWriter) Flush() {
-	if crw.err != nil {
+	_ = crw.FlushError()
+}
+
+// FlushError is like Flush, but reports errors. It is used by
+// http.ResponseController.
+func (crw *compressResponseWriter) FlushError() error {
+	if crw.err != nil || crw.closed {
+		return crw.err
+	}
+	if !crw.wroteHeader && !crw.hijacked {
+		// Flushing commits the header like Write does, e.g. for event
+		// streams that flush before the first event
+		crw.WriteHeader(http.StatusOK)
+	}
+	if crw.sniffing {
+		if crw.sniffType(nil); crw.err != nil {
+			return crw.err
+		}
+	}
+	if crw.cached != nil {
+		crw.err = crw.sendCached()
+		return crw.err
+	}
+	if crw.isBuffered {
+		// Flushing means the client wants to see data now, so the
+		// buffered content can't wait for Close
+		if err := crw.streamBuffered(); err != nil {
+			return err
+		}
+	}
+	if crw.isZBuffered {
+		if crw.err = crw.spill(); crw.err != nil {
+			return crw.err
+		}
+	}
+	crw.flush(FlushSync)
+	return crw.err
+}
+
+// Unwrap returns the underlying ResponseWriter, so http.ResponseController
+// can reach e.g. SetWriteDeadline or EnableFullDuplex.
+func (crw *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return crw.ResponseWriter
+}
+
+// writerOnly hides all methods but Write, so io.Copy can't recurse into
+// ReadFrom
+type writerOnly struct {
+	io.Writer
+}
+
+// ReadFrom copies src to the response. If the response is passed through
+// uncompressed, it is handed to the underlying ResponseWriter to keep
+// optimizations like sendfile for http.ServeFile.
+func (crw *compressResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !crw.wroteHeader && !crw.hijacked {
+		crw.WriteHeader(http.StatusOK)
+	}
+	if crw.err != nil || crw.closed || crw.z != nil || crw.isBuffered || crw.isZBuffered || crw.cacheHit || crw.head || crw.sniffing || len(crw.magic) > 0 {
+		return io.Copy(writerOnly{crw}, src)
+	}
+	n, err := io.Copy(crw.ResponseWriter, src)
+	crw.written += n
+	crw.err = errors.Wrap(err, "ReadFrom in compressResponseWriter failed")
+	return n, crw.err
+}
+
+// Hijack lets the handler take over the connection, e.g. for WebSockets, if
+// the underlying ResponseWriter supports it. Nothing is compressed afterwards.
+func (crw *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := crw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("compress: underlying ResponseWriter does not implement http.Hijacker")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	crw.hijacked = true
+	crw.closed = true
+	crw.z = nil
+	if crw.buf != nil {
+		putBuffer(crw.buf, crw.cfg.maxBuf)
+		crw.buf = nil
+	}
+	return conn, rw, nil
+}
+
+// Push initiates an HTTP/2 server push, if the underlying ResponseWriter
+// supports it, see http.Pusher. Pushed responses pass the middleware again.
+func (crw *compressResponseWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := crw.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// flushMode decides how to flush after a write to a streamed response
+func (crw *compressResponseWriter) flushMode() FlushMode {
+	mode := FlushNone
+	if crw.cfg.flushDecider != nil {
+		mode = crw.cfg.flushDecider(crw.written)
+	}
+	if mode == FlushNone && crw.cfg.autoFlush > 0 && crw.written-crw.flushed >= int64(crw.cfg.autoFlush) {
+		mode = FlushSync
+	}
+	if mode == FlushNone && crw.flushEachWrite {
+		mode = FlushSync
+	}
+	return mode
+}
+
+// flush flushes the compressor according to mode and the ResponseWriter
+// afterwards
+func (crw *compressResponseWriter) flush(mode FlushMode) {
+	if mode == FlushNone {
 		return
 	}
+	crw.flushed = crw.written
 	if crw.z != nil {
-		crw.err = errors.Wrap(crw.z.Flush(), "Flushing compressResponseWriter failed")
+		var err error
+		if ff, ok := crw.z.(fullFlusher); ok && mode == FlushFull {
+			err = ff.FullFlush()
+		} else {
+			err = crw.z.Flush()
+		}
+		crw.err = errors.Wrap(err, "Flushing compressResponseWriter failed")
+	}
+	// Reaches the Flusher even through wrappers that only provide Unwrap
+	_ = http.NewResponseController(crw.ResponseWriter).Flush()
+}
+
+// closeBuffered compresses the buffered content at once and writes it out
+// with a proper Content-Length.
+func (crw *compressResponseWriter) closeBuffered() error {
+	if crw.buf.Len() == 0 || crw.buf.Len() < crw.cfg.minLength {
+		// The handler wrote less than it announced or didn't announce
+		// anything and wrote too little
+		crw.skipped = SkipLength
+		crw.dropDigest()
+		return crw.writeBuffer(crw.buf)
+	}
+	if crw.looksCompressed(nil) {
+		crw.skipped = SkipEntropy
+		return crw.writeBuffer(crw.buf)
 	}
-	if flusher, ok := crw.ResponseWriter.(http.Flusher); ok {
-		flusher.Flush()
+
+	out := getBuffer()
+	defer putBuffer(out, crw.cfg.maxBuf)
+
+	start := time.Now()
+	z, err := crw.getCompressor(out, crw.buf.Len())
+	if err != nil {
+		// Rather deliver the content uncompressed than not at all
+		crw.cfg.logger.Printf("%v", err)
+		crw.skipped = SkipError
+		return crw.writeBuffer(crw.buf)
+	}
+	if _, err = z.Write(crw.buf.Bytes()); err == nil {
+		err = z.Close()
+	}
+	crw.compressTime += time.Since(start)
+	if err != nil {
+		// The original content is still there
+		crw.cfg.logger.Printf("%v", errors.Wrap(err, "Compressing buffer failed"))
+		crw.skipped = SkipError
+		return crw.writeBuffer(crw.buf)
+	}
+
+	if out.Len() >= crw.buf.Len() ||
+		crw.cfg.minRatio > 0 && float64(out.Len())/float64(crw.buf.Len()) > crw.cfg.minRatio {
+		// Compression doesn't pay off, send the original content instead
+		crw.skipped = SkipRatio
+		return crw.writeBuffer(crw.buf)
+	}
+
+	if crw.cacheable {
+		crw.cfg.cache.add(crw.cacheKey, out.Bytes())
 	}
+
+	crw.buf.Reset()
+	crw.setCompressionHeaders()
+	return crw.writeBuffer(out)
+}
+
+// sendCached writes the compressed content found in the cache
+func (crw *compressResponseWriter) sendCached() error {
+	body := crw.cached
+	crw.cached = nil
+	crw.setCompressionHeaders()
+	return errors.Wrap(crw.writeBuffer(bytes.NewBuffer(body)), "Writing cached response failed")
+}
+
+// writeBuffer writes the header and the complete content of b with a proper
+// Content-Length
+func (crw *compressResponseWriter) writeBuffer(b *bytes.Buffer) error {
+	if !hasTrailers(crw.Header()) && !checkHeaderHas(crw.Header(), hdrTransferEncoding) {
+		// Trailers set by the handler in the meantime require chunking
+		crw.Header().Set(hdrContentLength, strconv.Itoa(b.Len()))
+	}
+	crw.buffered = true
+	crw.setDebugHeaders(b.Len())
+	crw.addServerTiming(hdrServerTiming)
+	crw.ResponseWriter.WriteHeader(crw.code)
+	_, err := b.WriteTo(sentWriter{crw})
+	return err
 }
 
+// Close finishes the response. Calling it more than once returns the result
+// of the first call.
 func (crw *compressResponseWriter) Close() error {
+	if crw.closed {
+		return crw.err
+	}
+	crw.closed = true
+
 	if crw.err != nil {
+		// Most likely the client went away. Closing the compressor would
+		// only try to write to the dead connection again and mask the
+		// original error.
+		return crw.err
+	}
+	if isBodylessStatus(crw.code) {
+		return nil
+	}
+	defer http.NewResponseController(crw.ResponseWriter).Flush()
+	if crw.sniffing {
+		if crw.sniffType(nil); crw.err != nil {
+			return crw.err
+		}
+	}
+	if crw.cached != nil {
+		crw.err = crw.sendCached()
 		return crw.err
 	}
-	if flusher, ok := crw.ResponseWriter.(http.Flusher); ok {
-		defer flusher.Flush()
+	if crw.isBuffered && crw.holding && crw.buf.Len() > crw.bufferLimit() {
+		// The content collected for sniffing is long enough already
+		if crw.err = crw.streamBuffered(); crw.err != nil {
+			return crw.err
+		}
+	}
+	if crw.isBuffered {
+		crw.isBuffered = false
+		crw.err = crw.closeBuffered()
+		crw.releaseBuffer()
+		return crw.err
 	}
 	if crw.z == nil {
 		return nil
 	}
 
+	start := time.Now()
 	crw.err = errors.Wrap(crw.z.Close(), "Closing compressResponseWriter failed")
-	if crw.err != nil {
-		return crw.err
+	crw.compressTime += time.Since(start)
+	// The compressor may already be reused by another response
+	crw.z = nil
+	if crw.err == nil && crw.isZBuffered {
+		crw.isZBuffered = false
+		crw.setCompressionHeaders()
+		if crw.file != nil {
+			crw.err = crw.writeSpilled()
+		} else {
+			crw.err = crw.writeBuffer(crw.buf)
+		}
+		crw.releaseBuffer()
+	} else if crw.err == nil {
+		// The header is long gone
+		crw.addServerTiming(http.TrailerPrefix + hdrServerTiming)
 	}
-	if crw.isBuffered {
-		crw.Header().Set(hdrContentLength, strconv.Itoa(crw.buf.Len()))
-		crw.ResponseWriter.WriteHeader(crw.code)
-		_, crw.err = crw.buf.WriteTo(crw.ResponseWriter)
+	if crw.err == nil && crw.digest != nil {
+		crw.Header().Set(hdrDigest, "sha-256="+base64.StdEncoding.EncodeToString(crw.digest.Sum(nil)))
 	}
 	return crw.err
 }
 
+/*********\
+* Context *
+\*********/
+
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string {
+	return "compress context value " + k.name
+}
+
+// DisableCompressionKey is the context key used by DisableCompression. The
+// associated value is of type bool.
+var DisableCompressionKey = &contextKey{"disable-compression"}
+
+// DisableCompression returns a copy of ctx that makes the middleware skip
+// compression for a request, when set by a handler further up the chain:
+//
+//	next.ServeHTTP(w, r.WithContext(compress.DisableCompression(r.Context())))
+func DisableCompression(ctx context.Context) context.Context {
+	return context.WithValue(ctx, DisableCompressionKey, true)
+}
+
+func isCompressionDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(DisableCompressionKey).(bool)
+	return disabled
+}
+
+/*
+SkipCompression makes the middleware leave the response written to w
+uncompressed. It is meant for the wrapped handler, that only finds out while
+handling the request, e.g. before streaming binary data under a text
+Content-Type. It has to be called before the first call to WriteHeader or
+Write and does nothing, if w is not passed in by the middleware:
+
+	compress.SkipCompression(w)
+	w.Header().Set("Content-Type", "text/plain")
+	io.Copy(w, blob)
+*/
+func SkipCompression(w http.ResponseWriter) {
+	for {
+		switch rw := w.(type) {
+		case *compressResponseWriter:
+			if !rw.wroteHeader {
+				rw.skip = true
+			}
+			return
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return
+		}
+	}
+}
+
 /*
-New wraps a http.Handler and adds compression via gzip or deflate to the
-response. The Middleware takes care to not compress twice and will only
-compress known mimetypes. Small responses will be buffered completely and
-the Content-Length header will be set accordingly. Large responses as well
-as responses with unknown length will be compressed on the fly.
+New wraps a http.Handler and adds compression via brotli, zstd, gzip or
+deflate to the response. The Middleware takes care to not compress twice and
+will only compress known mimetypes. Responses are buffered up to
+CompressMaxBuf bytes (see WithMaxBuf), so small responses get a
+Content-Length header regardless of what the handler announced. Larger
+responses will be compressed on the fly.
 
 	...
 	log.Fatal(http.ListenAndServe(":8080", compress.New(http.DefaultServeMux))
 	...
 
+The behaviour can be adjusted by passing Options.
 */
-func New(h http.Handler) http.Handler {
-	return NewLevel(h, flate.DefaultCompression)
+func New(h http.Handler, opts ...Option) http.Handler {
+	return NewLevel(h, flate.DefaultCompression, opts...)
 }
 
 // NewLevel allows to set the compression level. See compress/flate.
-func NewLevel(h http.Handler, level int) http.Handler {
+func NewLevel(h http.Handler, level int, opts ...Option) http.Handler {
+	return newHandler(h, newConfig(level, opts))
+}
+
+// NewWithOptions is like New, but validates the options first and returns an
+// error describing the first invalid setting.
+func NewWithOptions(h http.Handler, opts ...Option) (http.Handler, error) {
+	cfg := newConfig(flate.DefaultCompression, opts)
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return newHandler(h, cfg), nil
+}
+
+func newHandler(h http.Handler, cfg *config) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Look for gzip/deflate in Accept-Encoding
-		comp := checkAcceptEncoding(r.Header)
+		// Nested middleware, the outer one already takes care of compression
+		if _, ok := w.(*compressResponseWriter); ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Compression was disabled earlier in the chain
+		if isCompressionDisabled(r.Context()) {
+			countSkip(SkipDisabled)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Compression was disabled for the path
+		if !cfg.pathAllowed(r.URL.Path) {
+			countSkip(SkipPath)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Client doesn't allow transformations of the response
+		if hasDirective(r.Header, hdrCacheControl, hdrCacheControlNoTransform) {
+			countSkip(SkipNoTransform)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Protocol upgrades like WebSockets take over the connection
+		if isUpgrade(r) {
+			countSkip(SkipUpgrade)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// HTTP/1.0 clients can't receive chunked responses
+		if cfg.http10 == HTTP10Skip && isHTTP10(r) {
+			countSkip(SkipHTTP10)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Client asked for no compression in the Prefer header
+		if cfg.respectPrefer && stripPreference(r.Header, hdrPreferNoCompression) {
+			countSkip(SkipPrefer)
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// Look for supported codings in Accept-Encoding
+		comp, acceptable := checkAcceptEncoding(r.Header, cfg.codings)
+		countEncoding(comp.String())
+		if !acceptable {
+			// Client refuses identity, but there is no other coding
+			http.Error(w, http.StatusText(http.StatusNotAcceptable), http.StatusNotAcceptable)
+			return
+		}
 		if comp == compNone {
 			// Client doesn't want compression, so skipping compression
+			countSkip(SkipNotAccepted)
 			h.ServeHTTP(w, r)
 			return
 		}
 
-		crw := newCompressResponseWriter(w, comp, level)
+		// Conditional requests carry the ETag of the compressed response
+		if cfg.etagMode == ETagSuffix {
+			stripETagSuffix(r.Header, hdrIfNoneMatch, comp)
+			stripETagSuffix(r.Header, hdrIfMatch, comp)
+		}
+
+		start := time.Now()
+		crw := newCompressResponseWriter(r, w, comp, cfg)
 		defer func() {
 			// clean even in case h panics
-			if err := crw.Close(); err != nil {
-				log.Printf("%v", err)
+			// Errors after the client canceled the request are just noise
+			if err := crw.Close(); err != nil && r.Context().Err() == nil {
+				cfg.handleError(r, err)
 			}
+			stats := crw.stats(start)
+			recordMetrics(stats)
+			if cfg.stats != nil {
+				cfg.stats(stats)
+			}
+			crw.release()
 		}()
 
 		h.ServeHTTP(crw, r)
 	})
 }
+
+// CompressHandler is a drop-in replacement for the function of the same name
+// in github.com/gorilla/handlers to ease migration. Like the original, it
+// only offers gzip and deflate and compresses responses of any type and
+// length. Content that doesn't get any smaller is still sent as is.
+func CompressHandler(h http.Handler) http.Handler {
+	return CompressHandlerLevel(h, gzip.DefaultCompression)
+}
+
+// CompressHandlerLevel is a drop-in replacement for the function of the same
+// name in github.com/gorilla/handlers, see CompressHandler. Like the
+// original, invalid levels are replaced by gzip.DefaultCompression.
+func CompressHandlerLevel(h http.Handler, level int) http.Handler {
+	if level < gzip.DefaultCompression || level > gzip.BestCompression {
+		level = gzip.DefaultCompression
+	}
+	cfg := newConfig(level, []Option{WithCompressableTypes("*/*"), WithMinLength(0)})
+	for c := range cfg.codings {
+		if c != compGzip && c != compDeflate {
+			delete(cfg.codings, c)
+		}
+	}
+	return newHandler(h, cfg)
+}
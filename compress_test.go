@@ -0,0 +1,1362 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// decode decompresses p according to encoding
+func decode(t *testing.T, encoding string, p []byte) []byte {
+	t.Helper()
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(p))
+	case "deflate":
+		r = flate.NewReader(bytes.NewReader(p))
+	case "zstd":
+		r, err = zstd.NewReader(bytes.NewReader(p))
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(p))
+	default:
+		return p
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", encoding, err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %v", encoding, err)
+	}
+	return out
+}
+
+func TestNewWriterCloseTwice(t *testing.T) {
+	content := []byte("Hello, hello, hello, World!")
+	for _, encoding := range []string{"gzip", "deflate", "zstd"} {
+		var first, second bytes.Buffer
+		w, err := NewWriter(&first, encoding, flate.DefaultCompression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(content)
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: %v", encoding, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Errorf("%s: second Close: %v", encoding, err)
+		}
+		if _, err := w.Write(content); err == nil {
+			t.Errorf("%s: Write after Close succeeded", encoding)
+		}
+
+		// Only one of two new writers may get the released compressor
+		w1, _ := NewWriter(&second, encoding, flate.DefaultCompression)
+		w2, _ := NewWriter(io.Discard, encoding, flate.DefaultCompression)
+		w1.Write(content)
+		w2.Write([]byte("something else entirely"))
+		w2.Close()
+		w1.Close()
+
+		for _, buf := range []*bytes.Buffer{&first, &second} {
+			if got := decode(t, encoding, buf.Bytes()); !bytes.Equal(got, content) {
+				t.Errorf("%s: got %q", encoding, got)
+			}
+		}
+	}
+}
+
+// get requests path from h, accepting encoding
+func get(h http.Handler, encoding string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if encoding != "" {
+		req.Header.Set(hdrAcceptEncoding, encoding)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestBufferingByActualLength(t *testing.T) {
+	small := strings.Repeat("Hello, World! ", 100)
+	large := strings.Repeat("Hello, World! ", 10000)
+	for _, tc := range []struct {
+		name      string
+		content   string
+		declared  string
+		hasLength bool
+	}{
+		{"small", small, "", true},
+		{"small declared large", small, "1000000", true},
+		{"large", large, "", false},
+		{"large declared small", large, "300", false},
+	} {
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			if tc.declared != "" {
+				w.Header().Set(hdrContentLength, tc.declared)
+			}
+			io.WriteString(w, tc.content)
+		}))
+		rec := get(h, "gzip")
+		hdr := rec.Result().Header
+		if ce := hdr.Get(hdrContentEncoding); ce != "gzip" {
+			t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+		}
+		cl := hdr.Get(hdrContentLength)
+		if tc.hasLength && cl != strconv.Itoa(rec.Body.Len()) {
+			t.Errorf("%s: Content-Length %q for %d bytes", tc.name, cl, rec.Body.Len())
+		}
+		if !tc.hasLength && cl != "" {
+			t.Errorf("%s: Content-Length %q", tc.name, cl)
+		}
+		if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != tc.content {
+			t.Errorf("%s: got %d bytes", tc.name, len(got))
+		}
+	}
+}
+
+func TestOverDeclaredBody(t *testing.T) {
+	chunk := strings.Repeat("Hello, World! ", 300)
+	var maxCap int
+	var size int
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrContentType, "text/plain")
+		w.Header().Set(hdrContentLength, "100")
+		crw := w.(*compressResponseWriter)
+		for size < 1<<20 {
+			n, _ := io.WriteString(w, chunk)
+			size += n
+			if crw.buf != nil && crw.buf.Cap() > maxCap {
+				maxCap = crw.buf.Cap()
+			}
+		}
+	}), WithMinLength(50))
+	rec := get(h, "gzip")
+	hdr := rec.Result().Header
+
+	if maxCap > 2*DefaultCompressMaxBuf {
+		t.Errorf("buffer grew to %d bytes", maxCap)
+	}
+	if ce := hdr.Get(hdrContentEncoding); ce != "gzip" {
+		t.Errorf("Content-Encoding %q", ce)
+	}
+	if cl := hdr.Get(hdrContentLength); cl != "" {
+		t.Errorf("Content-Length %q", cl)
+	}
+	if got := decode(t, "gzip", rec.Body.Bytes()); len(got) != size {
+		t.Errorf("got %d bytes, want %d", len(got), size)
+	}
+}
+
+func TestCompressHandlerLevel(t *testing.T) {
+	body := strings.Repeat("Hello, World! ", 100)
+	for _, level := range []int{-42, gzip.DefaultCompression, gzip.BestSpeed, gzip.BestCompression, 42} {
+		h := CompressHandlerLevel(handlerWith(body, hdrContentType, "text/plain"), level)
+		rec := get(h, "gzip")
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != "gzip" {
+			t.Errorf("level %d: Content-Encoding %q", level, ce)
+		}
+		if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != body {
+			t.Errorf("level %d: got %q", level, got)
+		}
+	}
+}
+
+func TestHeaderInvariants(t *testing.T) {
+	small := strings.Repeat("Hello, World! ", 100)
+	large := strings.Repeat("Hello, World! ", 10000)
+	for _, tc := range []struct {
+		name     string
+		ctype    string
+		content  string
+		kv       []string // further header fields set by the handler
+		opts     []Option
+		encoding string
+		length   bool // Content-Length present
+		vary     string
+		etag     string
+		ranges   string // Accept-Ranges
+	}{
+		{"buffered", "text/plain", small, nil, nil, "gzip", true, "Accept-Encoding", `"abc"`, ""},
+		{"streamed", "text/plain", large, nil, nil, "gzip", false, "Accept-Encoding", `"abc"`, ""},
+		{"too short", "text/plain", "Hello", nil, nil, "", true, "", `"abc"`, ""},
+		{"type", "image/png", small, nil, nil, "", false, "", `"abc"`, ""},
+		{"no-transform", "text/plain", small, []string{hdrCacheControl, "public, no-transform"}, nil, "", false, "", `"abc"`, ""},
+		{"no-transform ignored", "text/plain", small, []string{hdrCacheControl, "public, no-transform"},
+			[]Option{WithRespectNoTransform(false)}, "gzip", true, "Accept-Encoding", `"abc"`, ""},
+		{"vary", "text/plain", small, []string{hdrVary, "Origin"}, nil, "gzip", true, "Origin, Accept-Encoding", `"abc"`, ""},
+		{"vary present", "text/plain", small, []string{hdrVary, "Origin, accept-encoding"}, nil, "gzip", true, "Origin, accept-encoding", `"abc"`, ""},
+		{"vary star", "text/plain", small, []string{hdrVary, "*"}, nil, "gzip", true, "*", `"abc"`, ""},
+		{"vary uncompressed", "text/plain", "Hello", []string{hdrVary, "Origin"}, nil, "", true, "Origin", `"abc"`, ""},
+		{"weakened", "text/plain", small, nil, []Option{WithETag(ETagWeaken)}, "gzip", true, "Accept-Encoding", `W/"abc"`, ""},
+		{"weakened uncompressed", "text/plain", "Hello", nil, []Option{WithETag(ETagWeaken)}, "", true, "", `"abc"`, ""},
+		{"suffixed", "text/plain", small, nil, []Option{WithETag(ETagSuffix)}, "gzip", true, "Accept-Encoding", `"abc-gzip"`, ""},
+		{"suffixed weak", "text/plain", small, []string{hdrETag, `W/"abc"`}, []Option{WithETag(ETagSuffix)}, "gzip", true, "Accept-Encoding", `W/"abc-gzip"`, ""},
+		{"content range", "text/plain", small, []string{hdrContentRange, "bytes 0-1399/2800"}, nil, "", false, "", `"abc"`, ""},
+		{"accept ranges", "text/plain", small, []string{hdrAcceptRanges, "bytes"}, nil, "gzip", true, "Accept-Encoding", `"abc"`, "bytes"},
+		{"accept ranges stripped", "text/plain", small, []string{hdrAcceptRanges, "bytes"}, []Option{WithStripAcceptRanges(true)},
+			"gzip", true, "Accept-Encoding", `"abc"`, ""},
+		{"accept ranges uncompressed", "text/plain", "Hello", []string{hdrAcceptRanges, "bytes"}, []Option{WithStripAcceptRanges(true)},
+			"", true, "", `"abc"`, "bytes"},
+	} {
+		kv := append([]string{hdrContentType, tc.ctype, hdrETag, `"abc"`}, tc.kv...)
+		h := New(handlerWith(tc.content, kv...), tc.opts...)
+		rec := get(h, "gzip")
+		hdr := rec.Result().Header
+		if ce := hdr.Get(hdrContentEncoding); ce != tc.encoding {
+			t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+		}
+		if _, ok := hdr[hdrContentLength]; ok != tc.length {
+			t.Errorf("%s: Content-Length %q", tc.name, hdr.Get(hdrContentLength))
+		} else if ok && hdr.Get(hdrContentLength) != strconv.Itoa(rec.Body.Len()) {
+			t.Errorf("%s: Content-Length %s for %d bytes", tc.name, hdr.Get(hdrContentLength), rec.Body.Len())
+		}
+		if vary := hdr.Get(hdrVary); vary != tc.vary {
+			t.Errorf("%s: Vary %q", tc.name, vary)
+		}
+		if ranges := hdr.Get(hdrAcceptRanges); ranges != tc.ranges {
+			t.Errorf("%s: Accept-Ranges %q, want %q", tc.name, ranges, tc.ranges)
+		}
+		if etag := hdr.Get(hdrETag); etag != tc.etag {
+			t.Errorf("%s: ETag %s, want %s", tc.name, etag, tc.etag)
+		}
+		if got := decode(t, tc.encoding, rec.Body.Bytes()); string(got) != tc.content {
+			t.Errorf("%s: got %d bytes", tc.name, len(got))
+		}
+	}
+}
+
+// testLogger collects the logged messages
+type testLogger struct {
+	msgs []string
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.msgs = append(l.msgs, fmt.Sprintf(format, v...))
+}
+
+// headerCounter counts the calls to WriteHeader
+type headerCounter struct {
+	*httptest.ResponseRecorder
+	calls int
+}
+
+func (hc *headerCounter) WriteHeader(code int) {
+	hc.calls++
+	hc.ResponseRecorder.WriteHeader(code)
+}
+
+func TestDuplicateWriteHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+	}{
+		{"buffered", strings.Repeat("Hello, World! ", 100)},
+		{"streamed", strings.Repeat("Hello, World! ", 10000)},
+	} {
+		var logger testLogger
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			w.WriteHeader(http.StatusCreated)
+			w.WriteHeader(http.StatusAccepted)
+			io.WriteString(w, tc.content)
+			w.WriteHeader(http.StatusTeapot)
+		}), WithLogger(&logger))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		rec := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusCreated {
+			t.Errorf("%s: got status %d", tc.name, rec.Code)
+		}
+		if rec.calls != 1 {
+			t.Errorf("%s: WriteHeader called %d times", tc.name, rec.calls)
+		}
+		if len(logger.msgs) != 2 {
+			t.Errorf("%s: logged %q", tc.name, logger.msgs)
+		}
+		if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != tc.content {
+			t.Errorf("%s: got %d bytes", tc.name, len(got))
+		}
+	}
+}
+
+func TestPooledWritersConcurrent(t *testing.T) {
+	encodings := []string{"gzip", "deflate", "zstd", ""}
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("id")
+		w.Header().Set(hdrContentType, "text/plain")
+		w.Header().Set("X-Id", id)
+		n, _ := strconv.Atoi(id)
+		if n%3 == 0 {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		// Alternate between buffered and streamed responses
+		io.WriteString(w, strings.Repeat("id "+id+" ", 100+n%2*10000))
+	}))
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				id := strconv.Itoa(g*1000 + i)
+				n := g*1000 + i
+				encoding := encodings[n%len(encodings)]
+				req := httptest.NewRequest(http.MethodGet, "/?id="+id, nil)
+				if encoding != "" {
+					req.Header.Set(hdrAcceptEncoding, encoding)
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+
+				code := http.StatusOK
+				if n%3 == 0 {
+					code = http.StatusNotFound
+				}
+				hdr := rec.Result().Header
+				if rec.Code != code || hdr.Get("X-Id") != id || hdr.Get(hdrContentEncoding) != encoding {
+					t.Errorf("%s: got %d, %v", id, rec.Code, hdr)
+					return
+				}
+				want := strings.Repeat("id "+id+" ", 100+n%2*10000)
+				if got := decode(t, encoding, rec.Body.Bytes()); string(got) != want {
+					t.Errorf("%s: got %.40q", id, got)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func BenchmarkCompress(b *testing.B) {
+	content := strings.Repeat("Hello, World! ", 100)
+	h := New(handlerWith(content, hdrContentType, "text/plain"))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(hdrAcceptEncoding, "gzip")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
+
+func TestNestedMiddleware(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, encoding := range []string{"gzip", "br"} {
+		h := New(New(handlerWith(content, hdrContentType, "text/plain")))
+		rec := get(h, encoding)
+		hdr := rec.Result().Header
+		if ce := hdr.Values(hdrContentEncoding); len(ce) != 1 || ce[0] != encoding {
+			t.Errorf("%s: Content-Encoding %q", encoding, ce)
+		}
+		if got := decode(t, encoding, rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%s: got %.40q", encoding, got)
+		}
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrContentType, "text/plain")
+		w.Header().Set(hdrTrailer, "X-Checksum")
+		io.WriteString(w, content)
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "def")
+	}))
+	rec := get(h, "gzip")
+	res := rec.Result()
+	if ce := res.Header.Get(hdrContentEncoding); ce != "gzip" {
+		t.Errorf("Content-Encoding %q", ce)
+	}
+	if cl := res.Header.Get(hdrContentLength); cl != "" {
+		t.Errorf("Content-Length %s", cl)
+	}
+	if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != content {
+		t.Errorf("got %.40q", got)
+	}
+	if res.Trailer.Get("X-Checksum") != "abc" || res.Trailer.Get("X-Late") != "def" {
+		t.Errorf("Trailer %v", res.Trailer)
+	}
+}
+
+func TestDisableCompression(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	h := New(handlerWith(content, hdrContentType, "text/plain"))
+	for _, disable := range []bool{false, true} {
+		outer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if disable {
+				r = r.WithContext(DisableCompression(r.Context()))
+			}
+			h.ServeHTTP(w, r)
+		})
+		want := "gzip"
+		if disable {
+			want = ""
+		}
+		rec := get(outer, "gzip")
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != want {
+			t.Errorf("%v: Content-Encoding %q", disable, ce)
+		}
+		if got := decode(t, want, rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%v: got %d bytes", disable, len(got))
+		}
+	}
+}
+
+func TestEmptyResponses(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		minLength int
+		declared  string
+		content   string
+		length    string // expected Content-Length
+	}{
+		{"empty", 256, "", "", "0"},
+		{"empty, no minimum", 0, "", "", "0"},
+		{"short", 256, "", "Hello", "5"},
+		{"declared empty", 256, "0", "", "0"},
+		{"declared empty, no minimum", 0, "0", "", "0"},
+		{"declared short", 256, "5", "Hello", "5"},
+		{"declared short, longer", 256, "5", strings.Repeat("Hello, World! ", 100), "5"},
+		{"declared long, empty", 256, "1000", "", "0"},
+		{"declared long, empty, no minimum", 0, "1000", "", "0"},
+		{"declared long, short", 256, "1000", "Hello", "5"},
+	} {
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			if tc.declared != "" {
+				w.Header().Set(hdrContentLength, tc.declared)
+			}
+			w.WriteHeader(http.StatusOK)
+			io.WriteString(w, tc.content)
+		}), WithMinLength(tc.minLength))
+		rec := get(h, "gzip")
+		hdr := rec.Result().Header
+		if ce := hdr.Get(hdrContentEncoding); ce != "" {
+			t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+		}
+		if cl := hdr.Get(hdrContentLength); cl != tc.length {
+			t.Errorf("%s: Content-Length %q", tc.name, cl)
+		}
+		if rec.Body.String() != tc.content {
+			t.Errorf("%s: got %d bytes", tc.name, rec.Body.Len())
+		}
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	b := getBuffer()
+	b.WriteString("secret")
+	putBuffer(b, DefaultCompressMaxBuf)
+	for i := 0; i < 10; i++ {
+		if b := getBuffer(); b.Len() != 0 {
+			t.Fatalf("got buffer with %q", b.String())
+		}
+	}
+
+	large := getBuffer()
+	large.Grow(3 * DefaultCompressMaxBuf)
+	putBuffer(large, DefaultCompressMaxBuf)
+	for i := 0; i < 10; i++ {
+		if getBuffer() == large {
+			t.Fatal("got buffer larger than twice the buffer size")
+		}
+	}
+}
+
+func TestBufferReuse(t *testing.T) {
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		w.Header().Set(hdrContentType, "text/plain")
+		io.WriteString(w, q)
+	}))
+	for i := 0; i < 20; i++ {
+		// Alternate between compressed and uncompressed responses
+		q := strings.Repeat("secret-", 100)
+		if i%2 == 1 {
+			q = "x" + strconv.Itoa(i)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/?q="+q, nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if got := decode(t, rec.Result().Header.Get(hdrContentEncoding), rec.Body.Bytes()); string(got) != q {
+			t.Fatalf("%d: got %.40q", i, got)
+		}
+	}
+}
+
+func BenchmarkBuffered(b *testing.B) {
+	content := strings.Repeat("Hello, World! ", 1000)
+	h := New(handlerWith(content, hdrContentType, "text/plain"))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(hdrAcceptEncoding, "gzip")
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	})
+}
+
+func TestAcceptEncodingNormalization(t *testing.T) {
+	available := map[compType]int{compGzip: 2, compDeflate: 1}
+	for _, tc := range []struct {
+		accept string
+		want   compType
+	}{
+		{"GZIP", compGzip},
+		{"Gzip", compGzip},
+		{"DeFlate", compDeflate},
+		{"\tgzip\t", compGzip},
+		{"compress,\t\tdeflate", compDeflate},
+		{"x-foo ,  \t GZip  ", compGzip},
+		{"Gzip;q=0.5, DEFLATE;Q=0.8", compDeflate},
+		{"gzip ; q=0.5 ,\tdeflate\t;\tq=0.8", compDeflate},
+		{"GZIP;q=0, deflate", compDeflate},
+		{"IDENTITY, gzip;q=0.5", compNone},
+		{"*", compGzip},
+		{"gzip;q=0.5, *", compDeflate},
+		{"gzip;q=2, deflate", compDeflate},
+		{"deflate;q=0.8, gzip;q=0.8", compGzip},
+	} {
+		hdr := http.Header{hdrAcceptEncoding: {tc.accept}}
+		if got, _ := checkAcceptEncoding(hdr, available); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+}
+
+// errConnReset is returned by resetWriter
+var errConnReset = errors.New("connection reset by peer")
+
+// resetWriter fails like a connection reset by the client once more than
+// limit bytes were written
+type resetWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (rw *resetWriter) Write(p []byte) (int, error) {
+	if rw.Body.Len()+len(p) > rw.limit {
+		return 0, errConnReset
+	}
+	return rw.ResponseRecorder.Write(p)
+}
+
+func TestClientDisconnect(t *testing.T) {
+	for _, canceled := range []bool{false, true} {
+		var writeErr error
+		var errs []error
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			for i := 0; i < 1000 && writeErr == nil; i++ {
+				_, writeErr = fmt.Fprintf(w, "line %d %s\n", i, strings.Repeat("x", i%100))
+				w.(http.Flusher).Flush()
+			}
+		}), WithErrorHandler(func(r *http.Request, err error) {
+			errs = append(errs, err)
+		}))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		if canceled {
+			cancel()
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		h.ServeHTTP(&resetWriter{ResponseRecorder: httptest.NewRecorder(), limit: 1000}, req)
+		cancel()
+
+		if errors.Cause(writeErr) != errConnReset {
+			t.Errorf("canceled %v: Write returned %v", canceled, writeErr)
+		}
+		if canceled {
+			if len(errs) != 0 {
+				t.Errorf("canceled: reported %v", errs)
+			}
+			continue
+		}
+		if len(errs) != 1 || errors.Cause(errs[0]) != errConnReset {
+			t.Errorf("reported %v", errs)
+		}
+	}
+}
+
+func TestContentTypeParameters(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, tc := range []struct {
+		ctype string
+		want  string
+	}{
+		{"text/html; charset=utf-8", "gzip"},
+		{"application/json; charset=utf-8", "gzip"},
+		{"APPLICATION/JSON; Charset=UTF-8", "gzip"},
+		{"Text/HTML", "gzip"},
+		// Invalid parameters don't hide the media type
+		{"application/json;charset", "gzip"},
+		{"application/json; charset=utf-8; =", "gzip"},
+		{"application/jsonx", ""},
+		{"application/json-like-binary; charset=utf-8", ""},
+		{"; charset=utf-8", ""},
+		{"/", ""},
+	} {
+		rec := get(New(handlerWith(content, hdrContentType, tc.ctype)), "gzip")
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%q: Content-Encoding %q", tc.ctype, ce)
+		}
+		if got := decode(t, tc.want, rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%q: got %d bytes", tc.ctype, len(got))
+		}
+	}
+}
+
+func TestTransferEncodingChunked(t *testing.T) {
+	for _, content := range []string{
+		strings.Repeat("Hello, World! ", 100),
+		"Hello",
+	} {
+		srv := httptest.NewServer(New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			w.Header().Set(hdrTransferEncoding, "chunked")
+			io.WriteString(w, content)
+		})))
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := "gzip"
+		if len(content) < DefaultCompressMinLength {
+			want = ""
+		}
+		if ce := res.Header.Get(hdrContentEncoding); ce != want {
+			t.Errorf("%d bytes: Content-Encoding %q", len(content), ce)
+		}
+		if res.ContentLength != -1 || len(res.TransferEncoding) != 1 || res.TransferEncoding[0] != "chunked" {
+			t.Errorf("%d bytes: Content-Length %d, Transfer-Encoding %q", len(content), res.ContentLength, res.TransferEncoding)
+		}
+		if got := decode(t, want, body); string(got) != content {
+			t.Errorf("%d bytes: got %d bytes", len(content), len(got))
+		}
+	}
+}
+
+func TestWriterInterface(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	large := strings.Repeat("Hello, World! ", 10000)
+	for _, encoding := range []string{"gzip", "br"} {
+		var ok bool
+		var coding string
+		var status int
+		var compressed bool
+		var size int
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var cw Writer
+			if cw, ok = w.(Writer); !ok {
+				return
+			}
+			w.Header().Set(hdrContentType, "text/plain")
+			w.WriteHeader(http.StatusCreated)
+			coding, status = cw.Coding(), cw.Status()
+			io.WriteString(w, content)
+			io.WriteString(w, large)
+			compressed, size = cw.Compressed(), cw.UncompressedSize()
+		}))
+		get(h, encoding)
+		if !ok {
+			t.Fatalf("%s: ResponseWriter doesn't implement Writer", encoding)
+		}
+		if coding != encoding || status != http.StatusCreated {
+			t.Errorf("%s: got coding %q, status %d", encoding, coding, status)
+		}
+		if !compressed || size != len(content)+len(large) {
+			t.Errorf("%s: got compressed %v, size %d", encoding, compressed, size)
+		}
+	}
+}
+
+// interfaceWriter is a ResponseWriter recording which of its optional
+// interfaces were used
+type interfaceWriter struct {
+	*httptest.ResponseRecorder
+	used string
+}
+
+func (iw *interfaceWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	iw.used = "hijack"
+	conn, peer := net.Pipe()
+	peer.Close()
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+func (iw *interfaceWriter) Push(target string, opts *http.PushOptions) error {
+	iw.used = "push " + target
+	return nil
+}
+
+func (iw *interfaceWriter) SetWriteDeadline(deadline time.Time) error {
+	iw.used = "write deadline"
+	return nil
+}
+
+func (iw *interfaceWriter) ReadFrom(src io.Reader) (int64, error) {
+	iw.used = "read from"
+	return io.Copy(iw.ResponseRecorder, src)
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		plain bool // the underlying ResponseWriter lacks the interfaces
+		use   func(w http.ResponseWriter) error
+		used  string
+	}{
+		{"hijack", false, func(w http.ResponseWriter) error {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}, "hijack"},
+		{"hijack unsupported", true, func(w http.ResponseWriter) error {
+			_, _, err := w.(http.Hijacker).Hijack()
+			return err
+		}, ""},
+		{"push", false, func(w http.ResponseWriter) error {
+			return w.(http.Pusher).Push("/style.css", nil)
+		}, "push /style.css"},
+		{"push unsupported", true, func(w http.ResponseWriter) error {
+			return w.(http.Pusher).Push("/style.css", nil)
+		}, ""},
+		{"response controller", false, func(w http.ResponseWriter) error {
+			return http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Minute))
+		}, "write deadline"},
+		{"response controller unsupported", true, func(w http.ResponseWriter) error {
+			return http.NewResponseController(w).SetWriteDeadline(time.Now().Add(time.Minute))
+		}, ""},
+		{"read from uncompressed", false, func(w http.ResponseWriter) error {
+			w.Header().Set(hdrContentLength, "5")
+			// Without WriterTo, io.Copy has to use ReadFrom
+			_, err := io.Copy(w, io.LimitReader(strings.NewReader("Hello"), 5))
+			return err
+		}, "read from"},
+		{"read from compressed", false, func(w http.ResponseWriter) error {
+			_, err := io.Copy(w, io.LimitReader(strings.NewReader(strings.Repeat("Hello, World! ", 100)), 1400))
+			return err
+		}, ""},
+	} {
+		var err error
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			err = tc.use(w)
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		iw := &interfaceWriter{ResponseRecorder: httptest.NewRecorder()}
+		if tc.plain {
+			h.ServeHTTP(iw.ResponseRecorder, req)
+		} else {
+			h.ServeHTTP(iw, req)
+		}
+
+		if (err != nil) != tc.plain {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if iw.used != tc.used {
+			t.Errorf("%s: used %q, want %q", tc.name, iw.used, tc.used)
+		}
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	h := New(handlerWith(content, hdrContentType, "text/plain"))
+	for _, tc := range []struct {
+		accept string
+		code   int
+		want   string
+	}{
+		{"identity", http.StatusOK, ""},
+		{"identity, gzip", http.StatusOK, ""},
+		{"gzip, identity", http.StatusOK, "gzip"},
+		{"identity;q=1, gzip;q=0.5", http.StatusOK, ""},
+		{"gzip, identity;q=0", http.StatusOK, "gzip"},
+		{"gzip;q=0.5, identity;q=0.8", http.StatusOK, ""},
+		{"identity;q=0", http.StatusNotAcceptable, ""},
+		{"x-foo, identity;q=0", http.StatusNotAcceptable, ""},
+		{"*;q=0", http.StatusNotAcceptable, ""},
+		{"gzip;q=0, *;q=0", http.StatusNotAcceptable, ""},
+	} {
+		rec := get(h, tc.accept)
+		if rec.Code != tc.code {
+			t.Errorf("%q: got status %d", tc.accept, rec.Code)
+			continue
+		}
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%q: Content-Encoding %q", tc.accept, ce)
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		if got := decode(t, tc.want, rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%q: got %d bytes", tc.accept, len(got))
+		}
+	}
+}
+
+func TestRequestPassThrough(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	h := New(handlerWith(content, hdrContentType, "text/plain"))
+	for _, tc := range []struct {
+		kv   []string // request header fields
+		want string
+	}{
+		{nil, "gzip"},
+		{[]string{hdrCacheControl, "no-transform"}, ""},
+		{[]string{hdrCacheControl, "max-age=0, No-Transform"}, ""},
+		{[]string{hdrCacheControl, "no-cache"}, "gzip"},
+		{[]string{hdrCacheControl, `x-note="no-transform"`}, "gzip"},
+		{[]string{hdrCacheControl, "no-transformation"}, "gzip"},
+		{[]string{hdrConnection, "Upgrade", hdrUpgrade, "websocket"}, ""},
+		{[]string{hdrConnection, "keep-alive, upgrade", hdrUpgrade, "h2c"}, ""},
+		{[]string{hdrConnection, "Upgrade"}, "gzip"},
+		{[]string{hdrUpgrade, "websocket"}, "gzip"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		for i := 0; i+1 < len(tc.kv); i += 2 {
+			req.Header.Set(tc.kv[i], tc.kv[i+1])
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%q: Content-Encoding %q", tc.kv, ce)
+		}
+		if got := decode(t, tc.want, rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%q: got %d bytes", tc.kv, len(got))
+		}
+	}
+}
+
+func TestWriteHeaderAfterWrite(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	var logger testLogger
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrContentType, "text/plain")
+		io.WriteString(w, content[:10])
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, content[10:])
+	}), WithLogger(&logger))
+	rec := get(h, "gzip")
+	hdr := rec.Result().Header
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d", rec.Code)
+	}
+	if len(logger.msgs) != 1 || !strings.Contains(logger.msgs[0], "after Write") {
+		t.Errorf("logged %q", logger.msgs)
+	}
+	if ce := hdr.Get(hdrContentEncoding); ce != "gzip" {
+		t.Errorf("Content-Encoding %q", ce)
+	}
+	if cl := hdr.Get(hdrContentLength); cl != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("Content-Length %q for %d bytes", cl, rec.Body.Len())
+	}
+	if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != content {
+		t.Errorf("got %d bytes", len(got))
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	var errs []error
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrContentType, "text/plain")
+		io.WriteString(w, content)
+		c := w.(io.Closer)
+		errs = append(errs, c.Close(), c.Close())
+		w.(http.Flusher).Flush()
+		_, err := io.WriteString(w, content)
+		errs = append(errs, err)
+	}))
+	rec := get(h, "gzip")
+
+	if errs[0] != nil || errs[1] != nil {
+		t.Errorf("Close returned %v", errs[:2])
+	}
+	if errs[2] == nil {
+		t.Error("Write after Close succeeded")
+	}
+	if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != content {
+		t.Errorf("got %d bytes", len(got))
+	}
+}
+
+func TestFlushAfterClose(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, tc := range []struct {
+		name    string
+		content string
+	}{
+		{"buffered", content},
+		{"streamed", strings.Repeat(content, 100)},
+		{"empty", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		rec := httptest.NewRecorder()
+		crw := newCompressResponseWriter(req, rec, compGzip, newConfig(flate.DefaultCompression, nil))
+		crw.Header().Set(hdrContentType, "text/plain")
+		io.WriteString(crw, tc.content)
+		if err := crw.Close(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		size := rec.Body.Len()
+		if err := crw.FlushError(); err != nil {
+			t.Errorf("%s: Flush after Close: %v", tc.name, err)
+		}
+		crw.Flush()
+		if err := crw.Close(); err != nil {
+			t.Errorf("%s: second Close: %v", tc.name, err)
+		}
+		if rec.Body.Len() != size {
+			t.Errorf("%s: wrote %d bytes after Close", tc.name, rec.Body.Len()-size)
+		}
+		if got := decode(t, rec.Result().Header.Get(hdrContentEncoding), rec.Body.Bytes()); string(got) != tc.content {
+			t.Errorf("%s: got %d bytes", tc.name, len(got))
+		}
+	}
+}
+
+// unregisterCoding removes a coding registered by a test
+func unregisterCoding(token string) {
+	codingsMu.Lock()
+	defer codingsMu.Unlock()
+	delete(codings, toCompType(token))
+}
+
+func TestRegisterCoding(t *testing.T) {
+	// gzip under another token is enough to tell the factory was used
+	var calls int
+	RegisterCoding("x-test", func(w io.Writer, level int) (WriteCloseFlusher, error) {
+		calls++
+		return gzip.NewWriterLevel(w, level)
+	}, 0)
+	t.Cleanup(func() { unregisterCoding("x-test") })
+
+	content := strings.Repeat("Hello, World! ", 100)
+	h := New(handlerWith(content, hdrContentType, "text/plain"))
+	for _, tc := range []struct {
+		accept, want string
+	}{
+		{"x-test", "x-test"},
+		{"X-Test;q=0.9, gzip;q=0.5", "x-test"},
+		{"gzip, x-test", "gzip"},
+	} {
+		calls = 0
+		rec := get(h, tc.accept)
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%q: Content-Encoding %q", tc.accept, ce)
+		}
+		if want := tc.want == "x-test"; (calls == 1) != want {
+			t.Errorf("%q: factory called %d times", tc.accept, calls)
+		}
+		if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%q: got %.40q", tc.accept, got)
+		}
+	}
+}
+
+func TestAccessLogMiddleware(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	type entry struct {
+		status, size int
+		coding       string
+	}
+	var log []entry
+	accessLog := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r)
+			// The buffered response is not sent yet
+			if cw, ok := w.(Writer); ok {
+				log = append(log, entry{cw.Status(), cw.UncompressedSize(), cw.Coding()})
+			}
+		})
+	}
+	h := New(accessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrContentType, "text/plain")
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		io.WriteString(w, content)
+	})))
+
+	for _, path := range []string{"/", "/missing"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Body.Len() >= len(content) {
+			t.Errorf("%s: not compressed", path)
+		}
+	}
+	want := []entry{
+		{http.StatusOK, len(content), "gzip"},
+		{http.StatusNotFound, len(content), "gzip"},
+	}
+	if len(log) != len(want) || log[0] != want[0] || log[1] != want[1] {
+		t.Errorf("logged %v, want %v", log, want)
+	}
+}
+
+func TestExistingContentEncoding(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, tc := range []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{"none", nil, []string{"gzip"}},
+		{"empty", []string{""}, []string{"gzip"}},
+		{"identity", []string{"identity"}, []string{"gzip"}},
+		{"identity list", []string{"Identity, identity"}, []string{"gzip"}},
+		{"single", []string{"br"}, []string{"br"}},
+		{"multiple", []string{"identity", "deflate"}, []string{"identity", "deflate"}},
+		{"list", []string{"gzip, br"}, []string{"gzip, br"}},
+	} {
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			if tc.values != nil {
+				w.Header()[hdrContentEncoding] = tc.values
+			}
+			io.WriteString(w, content)
+		}))
+		rec := get(h, "gzip")
+		got := rec.Result().Header.Values(hdrContentEncoding)
+		if strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("%s: Content-Encoding %q, want %q", tc.name, got, tc.want)
+		}
+		body := rec.Body.Bytes()
+		if tc.want[0] == "gzip" {
+			body = decode(t, "gzip", body)
+		}
+		if string(body) != content {
+			t.Errorf("%s: got %.40q", tc.name, body)
+		}
+	}
+}
+
+// testEncoder is gzip under another name
+type testEncoder struct {
+	name     string
+	priority int
+}
+
+func (e testEncoder) Name() string  { return e.name }
+func (e testEncoder) Priority() int { return e.priority }
+func (e testEncoder) NewWriter(w io.Writer, level int) (WriteCloseFlusher, error) {
+	return gzip.NewWriterLevel(w, level)
+}
+
+func TestRegisterEncoder(t *testing.T) {
+	RegisterEncoder(testEncoder{"x-high", 10})
+	RegisterEncoder(testEncoder{"x-low", 0})
+	t.Cleanup(func() {
+		unregisterCoding("x-high")
+		unregisterCoding("x-low")
+	})
+
+	content := strings.Repeat("Hello, World! ", 100)
+	h := New(handlerWith(content, hdrContentType, "text/plain"))
+	for _, tc := range []struct {
+		accept, want string
+	}{
+		{"gzip, x-high", "x-high"},
+		{"x-low, gzip", "gzip"},
+		{"x-low, gzip;q=0.5", "x-low"},
+		{"x-low, x-high;q=0.5", "x-low"},
+	} {
+		rec := get(h, tc.accept)
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%q: Content-Encoding %q", tc.accept, ce)
+		}
+		if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%q: got %.40q", tc.accept, got)
+		}
+	}
+}
+
+func TestWriterPoolLevels(t *testing.T) {
+	content := lorem(8000)
+	for _, tc := range []struct {
+		encoding string
+		factory  CompressorFactory
+	}{
+		{"gzip", newGzipWriter},
+		{"deflate", newFlateWriter},
+	} {
+		// A pooled writer must not be handed out for another level
+		for _, level := range []int{flate.BestSpeed, flate.BestCompression, flate.BestSpeed} {
+			var buf bytes.Buffer
+			w, err := tc.factory(&buf, level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(w, content)
+			if err := w.Close(); err != nil {
+				t.Fatalf("%s: %v", tc.encoding, err)
+			}
+			if want := compressedSize(tc.encoding, level, content); buf.Len() != want {
+				t.Errorf("%s: got %d bytes, want %d for level %d", tc.encoding, buf.Len(), want, level)
+			}
+			if got := decode(t, tc.encoding, buf.Bytes()); string(got) != content {
+				t.Errorf("%s: got %d bytes", tc.encoding, len(got))
+			}
+		}
+	}
+}
+
+func TestFlushBeforeWrite(t *testing.T) {
+	content := strings.Repeat("data: event\n\n", 100)
+	for _, contentType := range []string{"text/event-stream", "text/plain", ""} {
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if contentType != "" {
+				w.Header().Set(hdrContentType, contentType)
+			}
+			w.(http.Flusher).Flush()
+			io.WriteString(w, content)
+		}))
+		// Without a type there is nothing to sniff at the time of the
+		// flush, so the content is sent as is
+		want := "gzip"
+		if contentType == "" {
+			want = ""
+		}
+		rec := get(h, "gzip")
+		if !rec.Flushed {
+			t.Errorf("%q: not flushed", contentType)
+		}
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != want {
+			t.Errorf("%q: Content-Encoding %q", contentType, ce)
+		}
+		if got := decode(t, want, rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%q: got %q", contentType, got)
+		}
+	}
+}
+
+func TestETagSuffixConditional(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 1000)
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrETag, `"abc"`)
+		http.ServeContent(w, r, "hello.txt", time.Time{}, strings.NewReader(content))
+	}), WithETag(ETagSuffix))
+
+	rec := get(h, "gzip")
+	etag := rec.Result().Header.Get(hdrETag)
+	if etag != `"abc-gzip"` {
+		t.Fatalf("ETag %s", etag)
+	}
+
+	for _, tc := range []struct {
+		key, value string
+		code       int
+	}{
+		{hdrIfNoneMatch, etag, http.StatusNotModified},
+		{hdrIfNoneMatch, `"xyz", ` + etag, http.StatusNotModified},
+		{hdrIfNoneMatch, `"abc-br"`, http.StatusOK},
+		{hdrIfMatch, etag, http.StatusOK},
+		{hdrIfMatch, `"xyz-gzip"`, http.StatusPreconditionFailed},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		req.Header.Set(tc.key, tc.value)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s: %s: got %d, want %d", tc.key, tc.value, rec.Code, tc.code)
+		}
+	}
+}
+
+func TestNotModifiedHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		mode ETagMode
+		etag string
+	}{
+		{ETagKeep, `"abc"`},
+		{ETagWeaken, `W/"abc"`},
+		{ETagSuffix, `"abc-gzip"`},
+	} {
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrETag, `"abc"`)
+			w.Header().Set(hdrVary, "Origin")
+			w.WriteHeader(http.StatusNotModified)
+		}), WithETag(tc.mode))
+		hdr := get(h, "gzip").Result().Header
+		if etag := hdr.Get(hdrETag); etag != tc.etag {
+			t.Errorf("%d: ETag %s, want %s", tc.mode, etag, tc.etag)
+		}
+		if vary := hdr.Get(hdrVary); vary != "Origin, Accept-Encoding" {
+			t.Errorf("%d: Vary %q", tc.mode, vary)
+		}
+		if ce := hdr.Get(hdrContentEncoding); ce != "" {
+			t.Errorf("%d: Content-Encoding %q", tc.mode, ce)
+		}
+	}
+}
+
+func TestStreamingMinLength(t *testing.T) {
+	long := strings.Repeat("Hello, World! ", 1000)
+	for _, tc := range []struct {
+		name    string
+		opts    []Option
+		header  string
+		content string
+		want    string
+	}{
+		{"empty", []Option{WithNoBuffering()}, "", "", ""},
+		{"short", []Option{WithNoBuffering()}, "", long[:100], ""},
+		{"long", []Option{WithNoBuffering()}, "", long, "gzip"},
+		{"trailer empty", nil, hdrTrailer, "", ""},
+		{"trailer short", nil, hdrTrailer, long[:100], ""},
+		{"trailer long", nil, hdrTrailer, long, "gzip"},
+	} {
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			if tc.header != "" {
+				w.Header().Set(tc.header, "X-Checksum")
+			}
+			w.WriteHeader(http.StatusOK)
+			for rest := tc.content; rest != ""; {
+				n := 10
+				if n > len(rest) {
+					n = len(rest)
+				}
+				io.WriteString(w, rest[:n])
+				rest = rest[n:]
+			}
+		}), append(tc.opts, WithMinLength(256))...)
+		rec := get(h, "gzip")
+		hdr := rec.Result().Header
+		if ce := hdr.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+		}
+		if got := decode(t, tc.want, rec.Body.Bytes()); string(got) != tc.content {
+			t.Errorf("%s: got %d bytes", tc.name, len(got))
+		}
+		if tc.want == "gzip" && hdr.Get(hdrContentLength) != "" {
+			t.Errorf("%s: Content-Length %s", tc.name, hdr.Get(hdrContentLength))
+		}
+	}
+}
+
+func TestCompressHandler(t *testing.T) {
+	text := strings.Repeat("Hello, World! ", 10)
+	png := string([]byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}) + strings.Repeat("\x00", 100)
+	for _, tc := range []struct {
+		name   string
+		accept string
+		ctype  string
+		body   string
+		want   string
+	}{
+		{"gzip", "gzip", "text/plain", text, "gzip"},
+		{"deflate", "deflate", "text/plain", text, "deflate"},
+		{"no coding", "", "text/plain", text, ""},
+		{"no br", "br", "text/plain", text, ""},
+		{"no zstd", "zstd, gzip;q=0.5", "text/plain", text, "gzip"},
+		{"any type", "gzip", "image/png", png, "gzip"},
+		{"sniffed type", "gzip", "", png, "gzip"},
+	} {
+		h := CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tc.ctype != "" {
+				w.Header().Set(hdrContentType, tc.ctype)
+			}
+			io.WriteString(w, tc.body)
+		}))
+		rec := get(h, tc.accept)
+		hdr := rec.Result().Header
+		if ce := hdr.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%s: Content-Encoding %q, want %q", tc.name, ce, tc.want)
+		}
+		if tc.want != "" && hdr.Get(hdrVary) != hdrAcceptEncoding {
+			t.Errorf("%s: Vary %q", tc.name, hdr.Get(hdrVary))
+		}
+		if got := decode(t, tc.want, rec.Body.Bytes()); string(got) != tc.body {
+			t.Errorf("%s: got %q", tc.name, got)
+		}
+	}
+}
+
+func TestCompressHandlerEncoded(t *testing.T) {
+	h := CompressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrContentEncoding, "br")
+		io.WriteString(w, "not really brotli")
+	}))
+	rec := get(h, "gzip")
+	if ce := rec.Result().Header.Get(hdrContentEncoding); ce != "br" {
+		t.Errorf("Content-Encoding %q", ce)
+	}
+	if rec.Body.String() != "not really brotli" {
+		t.Errorf("got %q", rec.Body.String())
+	}
+}
+
+func TestUnavailableCodingSkipped(t *testing.T) {
+	available := map[compType]int{compGzip: 2, compDeflate: 1}
+	for _, tc := range []struct {
+		accept string
+		want   compType
+	}{
+		{"br, gzip", compGzip},
+		{"br;q=1, zstd;q=0.9, deflate;q=0.5", compDeflate},
+		{"br, zstd", compNone},
+	} {
+		hdr := http.Header{hdrAcceptEncoding: {tc.accept}}
+		if got, _ := checkAcceptEncoding(hdr, available); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+
+	// CompressHandler only offers gzip and deflate
+	content := strings.Repeat("Hello, World! ", 100)
+	rec := get(CompressHandler(handlerWith(content, hdrContentType, "text/plain")), "br, gzip")
+	if ce := rec.Result().Header.Get(hdrContentEncoding); ce != "gzip" {
+		t.Errorf("Content-Encoding %q", ce)
+	}
+	if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != content {
+		t.Errorf("got %d bytes", len(got))
+	}
+}
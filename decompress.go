@@ -0,0 +1,269 @@
+package compress
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// decompressReader decompresses a request body. The decompressor is opened on
+// the first Read, so malformed bodies surface as read errors.
+type decompressReader struct {
+	body io.ReadCloser
+	open func(io.Reader) (io.ReadCloser, error)
+
+	r   io.ReadCloser
+	err error
+}
+
+func (d *decompressReader) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.r, d.err = d.open(d.body)
+		d.err = errors.Wrap(d.err, "Opening decompressor failed")
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.r.Read(p)
+}
+
+func (d *decompressReader) Close() error {
+	if d.r != nil {
+		d.r.Close()
+	}
+	return d.body.Close()
+}
+
+func openGzipReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func openFlateReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+func openBrotliReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(brotli.NewReader(r)), nil
+}
+
+// zstdReader adapts the Close method of zstd.Decoder
+type zstdReader struct {
+	*zstd.Decoder
+}
+
+func (z zstdReader) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// zstdMaxWindow is the largest window decoders have to support for HTTP
+// according to RFC 9659. Frames declaring larger ones are rejected, as the
+// window is allocated up front.
+const zstdMaxWindow = 8 << 20
+
+// zstdOpener returns the function to open a zstd decompressor. A limit > 0 on
+// the decompressed size bounds the window as well, so a tiny frame can't make
+// the decoder allocate a lot of memory.
+func zstdOpener(limit int64) func(io.Reader) (io.ReadCloser, error) {
+	window := uint64(zstdMaxWindow)
+	if limit > 0 && uint64(limit) < window {
+		window = uint64(limit)
+		if window < zstd.MinWindowSize {
+			window = zstd.MinWindowSize
+		}
+	}
+	return func(r io.Reader) (io.ReadCloser, error) {
+		d, err := zstd.NewReader(r,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderLowmem(true),
+			zstd.WithDecoderMaxWindow(window),
+			zstd.WithDecoderMaxMemory(window))
+		if err != nil {
+			return nil, err
+		}
+		return zstdReader{d}, nil
+	}
+}
+
+// limitedBody fails reads once more than the limit was decompressed, to guard
+// against decompression bombs
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	n        int64 // remaining bytes
+	exceeded bool
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, &http.MaxBytesError{Limit: l.limit}
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	if int64(n) <= l.n {
+		l.n -= int64(n)
+		return n, err
+	}
+	n = int(l.n)
+	l.n = 0
+	l.exceeded = true
+	return n, &http.MaxBytesError{Limit: l.limit}
+}
+
+// limitResponseWriter replaces the response with 413 Content Too Large, if the
+// request body exceeded the limit before the handler started its response.
+type limitResponseWriter struct {
+	http.ResponseWriter
+	body *limitedBody
+
+	wroteHeader bool
+	rejected    bool
+}
+
+func (lw *limitResponseWriter) WriteHeader(code int) {
+	if lw.wroteHeader {
+		return
+	}
+	lw.wroteHeader = true
+	if lw.body.exceeded {
+		lw.rejected = true
+		lw.Header().Del(hdrContentLength)
+		lw.Header().Del(hdrContentEncoding)
+		http.Error(lw.ResponseWriter, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	lw.ResponseWriter.WriteHeader(code)
+}
+
+func (lw *limitResponseWriter) Write(p []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+	if lw.rejected {
+		// the handler's response is dropped
+		return len(p), nil
+	}
+	return lw.ResponseWriter.Write(p)
+}
+
+func (lw *limitResponseWriter) Flush() {
+	_ = http.NewResponseController(lw.ResponseWriter).Flush()
+}
+
+// Unwrap is used by http.ResponseController
+func (lw *limitResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// finish sends the 413 response if the handler didn't respond at all
+func (lw *limitResponseWriter) finish() {
+	if !lw.wroteHeader && lw.body.exceeded {
+		lw.WriteHeader(http.StatusRequestEntityTooLarge)
+	}
+}
+
+// getDecompressor returns the function to open a decompressor for the coding
+// or nil, if it is not supported. limit is the maximum decompressed size or 0.
+func getDecompressor(coding string, limit int64) func(io.Reader) (io.ReadCloser, error) {
+	switch coding {
+	case hdrContentEncodingGzip:
+		return openGzipReader
+	case hdrContentEncodingDeflate:
+		return openFlateReader
+	case hdrContentEncodingBrotli:
+		return openBrotliReader
+	case hdrContentEncodingZstd:
+		return zstdOpener(limit)
+	default:
+		return nil
+	}
+}
+
+// getDecompressors returns the functions to open decompressors for all
+// codings of the Content-Encoding in the order they have to be applied, i.e.
+// reversed. identity is skipped. ok is false if a coding is not supported.
+// limit is the maximum decompressed size or 0.
+func getDecompressors(hdr http.Header, limit int64) (opens []func(io.Reader) (io.ReadCloser, error), ok bool) {
+	codings := splitHeaderList(hdr, hdrContentEncoding)
+	for i := len(codings) - 1; i >= 0; i-- {
+		coding := strings.ToLower(codings[i])
+		if coding == hdrContentEncodingIdentity {
+			continue
+		}
+		open := getDecompressor(coding, limit)
+		if open == nil {
+			return nil, false
+		}
+		opens = append(opens, open)
+	}
+	return opens, true
+}
+
+// supportedDecodings lists the codings for the Accept-Encoding header of
+// 415 responses
+const supportedDecodings = "gzip, deflate, br, zstd"
+
+// decompressHandler decompresses request bodies. Requests with unsupported
+// codings are rejected if strict is set and passed on untouched otherwise.
+func decompressHandler(h http.Handler, strict bool, cfg *config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opens, ok := getDecompressors(r.Header, cfg.maxDecompressed)
+		if !ok && strict {
+			// RFC 9110 15.5.16: tell the client what would have worked
+			w.Header().Set(hdrAcceptEncoding, supportedDecodings)
+			http.Error(w, http.StatusText(http.StatusUnsupportedMediaType), http.StatusUnsupportedMediaType)
+			return
+		}
+		if !ok || len(opens) == 0 || r.Body == nil || r.Body == http.NoBody {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		for _, open := range opens {
+			r.Body = &decompressReader{body: r.Body, open: open}
+		}
+		r.Header.Del(hdrContentEncoding)
+		r.Header.Del(hdrContentLength)
+		r.ContentLength = -1
+
+		if cfg.maxDecompressed > 0 {
+			body := &limitedBody{ReadCloser: r.Body, limit: cfg.maxDecompressed, n: cfg.maxDecompressed}
+			r.Body = body
+			lw := &limitResponseWriter{ResponseWriter: w, body: body}
+			defer lw.finish()
+			w = lw
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+/*
+NewRequestDecompressor wraps a http.Handler and transparently decompresses
+request bodies sent with a Content-Encoding of gzip, deflate, br or zstd. The
+Content-Encoding and Content-Length headers are removed, so h only ever sees
+the decoded body. Requests with other encodings are passed on untouched.
+Of the Options, only WithMaxDecompressedBody applies.
+*/
+func NewRequestDecompressor(h http.Handler, opts ...Option) http.Handler {
+	return decompressHandler(h, false, newConfig(flate.DefaultCompression, opts))
+}
+
+/*
+Decompress is like NewRequestDecompressor, but rejects requests with
+unsupported encodings with 415 Unsupported Media Type. Useful for API servers
+receiving compressed uploads:
+
+	http.Handle("/upload", compress.Decompress(uploadHandler))
+*/
+func Decompress(h http.Handler, opts ...Option) http.Handler {
+	return decompressHandler(h, true, newConfig(flate.DefaultCompression, opts))
+}
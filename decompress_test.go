@@ -0,0 +1,180 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// zstdWindowBomb is an empty zstd frame declaring a 512 MiB window
+var zstdWindowBomb = []byte{
+	0x28, 0xb5, 0x2f, 0xfd, // magic
+	0x00,             // frame header descriptor: no content size
+	19 << 3,          // window descriptor: 1 << (10 + 19)
+	0x01, 0x00, 0x00, // last raw block of size 0
+}
+
+func TestDecompressZstdWindowLimit(t *testing.T) {
+	var readErr error
+	h := Decompress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	}), WithMaxDecompressedBody(1024))
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(zstdWindowBomb))
+	req.Header.Set(hdrContentEncoding, hdrContentEncodingZstd)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	runtime.ReadMemStats(&after)
+
+	if readErr == nil {
+		t.Error("reading a body with an oversized window succeeded")
+	}
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+		t.Errorf("decompressing allocated %d bytes", alloc)
+	}
+}
+
+// encode compresses p according to encoding
+func encode(t *testing.T, encoding string, p []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	default:
+		t.Fatalf("unknown encoding %q", encoding)
+	}
+	w.Write(p)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRequestDecompressor(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, encoding := range []string{"gzip", "deflate", "GZip"} {
+		var got []byte
+		var readErr error
+		var hdr http.Header
+		h := NewRequestDecompressor(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hdr = r.Header
+			got, readErr = io.ReadAll(r.Body)
+		}))
+		body := encode(t, strings.ToLower(encoding), []byte(content))
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req.Header.Set(hdrContentEncoding, encoding)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		if readErr != nil || string(got) != content {
+			t.Errorf("%s: got %d bytes, %v", encoding, len(got), readErr)
+		}
+		if hdr.Get(hdrContentEncoding) != "" || hdr.Get(hdrContentLength) != "" {
+			t.Errorf("%s: handler got %v", encoding, hdr)
+		}
+	}
+}
+
+func TestRequestDecompressorMalformed(t *testing.T) {
+	body := encode(t, "gzip", []byte(strings.Repeat("Hello, World! ", 100)))
+	for name, p := range map[string][]byte{
+		"truncated": body[:len(body)/2],
+		"garbage":   []byte("definitely not gzip"),
+		"empty":     nil,
+	} {
+		var readErr error
+		h := NewRequestDecompressor(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, readErr = io.ReadAll(r.Body)
+		}))
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(p))
+		req.Header.Set(hdrContentEncoding, "gzip")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if readErr == nil {
+			t.Errorf("%s: no read error", name)
+		}
+	}
+}
+
+func TestDecompressUnsupported(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, tc := range []struct {
+		encoding string
+		code     int
+	}{
+		{"gzip", http.StatusOK},
+		{"identity", http.StatusOK},
+		{"compress", http.StatusUnsupportedMediaType},
+		{"gzip, x-foo", http.StatusUnsupportedMediaType},
+	} {
+		var called bool
+		h := Decompress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+		body := []byte(content)
+		if tc.encoding == "gzip" {
+			body = encode(t, "gzip", body)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req.Header.Set(hdrContentEncoding, tc.encoding)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tc.code || called != (tc.code == http.StatusOK) {
+			t.Errorf("%s: status %d, handler called %v", tc.encoding, rec.Code, called)
+		}
+		ae := rec.Result().Header.Get(hdrAcceptEncoding)
+		if tc.code == http.StatusUnsupportedMediaType && ae != supportedDecodings || tc.code == http.StatusOK && ae != "" {
+			t.Errorf("%s: Accept-Encoding %q", tc.encoding, ae)
+		}
+	}
+}
+
+func TestMaxDecompressedBody(t *testing.T) {
+	const limit = 1000
+	for _, tc := range []struct {
+		size int
+		code int
+	}{
+		{limit - 1, http.StatusOK},
+		{limit, http.StatusOK},
+		{limit + 1, http.StatusRequestEntityTooLarge},
+	} {
+		var got []byte
+		var readErr error
+		h := Decompress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, readErr = io.ReadAll(r.Body)
+			io.WriteString(w, "ok")
+		}), WithMaxDecompressedBody(limit))
+		body := encode(t, "gzip", []byte(strings.Repeat("a", tc.size)))
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req.Header.Set(hdrContentEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != tc.code {
+			t.Errorf("%d bytes: status %d, want %d", tc.size, rec.Code, tc.code)
+		}
+		var maxErr *http.MaxBytesError
+		if tooLarge := errors.As(readErr, &maxErr); tooLarge != (tc.code != http.StatusOK) {
+			t.Errorf("%d bytes: read error %v", tc.size, readErr)
+		}
+		if tc.code == http.StatusOK && (len(got) != tc.size || rec.Body.String() != "ok") {
+			t.Errorf("%d bytes: handler got %d bytes, responded %q", tc.size, len(got), rec.Body.String())
+		}
+		if tc.code != http.StatusOK && len(got) != limit {
+			t.Errorf("%d bytes: handler got %d bytes before the error", tc.size, len(got))
+		}
+	}
+}
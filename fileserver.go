@@ -0,0 +1,95 @@
+package compress
+
+import (
+	"compress/flate"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// sidecarExts maps codings to the extensions of precompressed files
+var sidecarExts = map[compType]string{
+	compBrotli: ".br",
+	compZstd:   ".zst",
+	compGzip:   ".gz",
+}
+
+// findSidecars returns the preferences of the codings for which a
+// precompressed version of name exists in fsys
+func findSidecars(fsys fs.FS, name string, prefs map[compType]int) map[compType]int {
+	available := make(map[compType]int)
+	for c, ext := range sidecarExts {
+		pref, ok := prefs[c]
+		if !ok {
+			continue
+		}
+		if fi, err := fs.Stat(fsys, name+ext); err == nil && fi.Mode().IsRegular() {
+			available[c] = pref
+		}
+	}
+	return available
+}
+
+// serveSidecar serves the precompressed version of name with coding c. It
+// reports false if nothing was written, e.g. because the file can't seek.
+func serveSidecar(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string, c compType) bool {
+	f, err := fsys.Open(name + sidecarExts[c])
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+
+	hdr := w.Header()
+	// ServeContent would sniff the compressed bytes otherwise
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		ctype = "application/octet-stream"
+	}
+	hdr.Set(hdrContentType, ctype)
+	hdr.Set(hdrContentEncoding, c.String())
+	addVary(hdr, hdrAcceptEncoding)
+	http.ServeContent(w, r, name, fi.ModTime(), content)
+	return true
+}
+
+/*
+FileServer serves the files of fsys like http.FileServer. If the client
+accepts it, a precompressed version next to the requested file is served
+instead, e.g. style.css.br, style.css.zst or style.css.gz for style.css.
+Everything else is compressed on the fly as configured by the Options, like
+with New.
+
+	http.Handle("/static/", http.StripPrefix("/static", compress.FileServer(os.DirFS("static"))))
+*/
+func FileServer(fsys fs.FS, opts ...Option) http.Handler {
+	cfg := newConfig(flate.DefaultCompression, opts)
+	fallback := newHandler(http.FileServer(http.FS(fsys)), cfg)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		if name == "" || strings.HasSuffix(r.URL.Path, "/") || isCompressionDisabled(r.Context()) {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		available := findSidecars(fsys, name, cfg.codings)
+		if len(available) == 0 {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+		comp, _ := checkAcceptEncoding(r.Header, available)
+		if comp == compNone || !serveSidecar(w, r, fsys, name, comp) {
+			fallback.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package compress
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFileServer(t *testing.T) {
+	css := strings.Repeat("body { color: black; }\n", 100)
+	fsys := fstest.MapFS{
+		"style.css":    {Data: []byte(css)},
+		"style.css.gz": {Data: []byte("precompressed gzip")},
+		"style.css.br": {Data: []byte("precompressed brotli")},
+		"app.js":       {Data: []byte(css)},
+	}
+	h := FileServer(fsys)
+
+	for _, tc := range []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		rng            string
+		code           int
+		encoding       string
+		body           string
+	}{
+		{"gzip sidecar", "/style.css", "gzip", "", http.StatusOK, "gzip", "precompressed gzip"},
+		{"br sidecar", "/style.css", "gzip;q=0.5, br", "", http.StatusOK, "br", "precompressed brotli"},
+		{"zstd missing", "/style.css", "zstd, gzip;q=0.5", "", http.StatusOK, "gzip", "precompressed gzip"},
+		{"refused", "/style.css", "gzip;q=0", "", http.StatusOK, "", css},
+		{"identity", "/style.css", "", "", http.StatusOK, "", css},
+		{"range", "/style.css", "gzip", "bytes=0-12", http.StatusPartialContent, "gzip", "precompressed"},
+		{"no sidecar", "/app.js", "gzip", "", http.StatusOK, "gzip", css},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.acceptEncoding != "" {
+			req.Header.Set(hdrAcceptEncoding, tc.acceptEncoding)
+		}
+		if tc.rng != "" {
+			req.Header.Set(hdrRange, tc.rng)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		hdr := rec.Result().Header
+
+		if rec.Code != tc.code {
+			t.Errorf("%s: status %d, want %d", tc.name, rec.Code, tc.code)
+		}
+		if ce := hdr.Get(hdrContentEncoding); ce != tc.encoding {
+			t.Errorf("%s: Content-Encoding %q, want %q", tc.name, ce, tc.encoding)
+		}
+		if ct := hdr.Get(hdrContentType); !strings.HasPrefix(ct, "text/css") && tc.path == "/style.css" {
+			t.Errorf("%s: Content-Type %q", tc.name, ct)
+		}
+		if vary := hdr.Get(hdrVary); tc.encoding != "" && vary != hdrAcceptEncoding {
+			t.Errorf("%s: Vary %q", tc.name, vary)
+		}
+		body := rec.Body.Bytes()
+		if tc.path == "/app.js" {
+			body = decode(t, tc.encoding, body)
+		}
+		if string(body) != tc.body {
+			t.Errorf("%s: got %q", tc.name, body)
+		}
+	}
+}
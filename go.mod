@@ -0,0 +1,9 @@
+module github.com/lemmi/compress
+
+go 1.22
+
+require (
+	github.com/andybalholm/brotli v1.2.5
+	github.com/klauspost/compress v1.17.11
+	github.com/pkg/errors v0.9.1
+)
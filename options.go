@@ -0,0 +1,882 @@
+package compress
+
+import (
+	"compress/flate"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// Logger is the interface used to report problems. It is satisfied by
+// *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// stdLogger logs via the standard logger of package log
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// CompressorFactory creates a compressor writing to w. The level is the
+// configured compression level, which is interpreted by the factory.
+type CompressorFactory func(w io.Writer, level int) (WriteCloseFlusher, error)
+
+// Option configures the middleware returned by New, NewLevel and
+// NewWithOptions.
+type Option func(*config)
+
+// config holds the settings of a single middleware instance.
+type config struct {
+	level        int
+	codingLevels map[string]int
+	minLength    int
+	maxBuf       int
+
+	compressStatus            func(code int) bool
+	threshold                 int
+	noBuffering               bool
+	minRatio                  float64
+	compressIfContentLanguage bool
+	types                     []string
+	shouldCompress            func(code int, hdr http.Header, r *http.Request) bool
+	skipSensitive             bool
+	padding                   int
+	deterministicGzip         bool
+	excludePaths              pathMatcher
+	includePaths              pathMatcher
+	excludedTypes             []string
+	sniffEntropy              bool
+	respectPrefer             bool
+	ignoreNoTransform         bool
+	digestTrailer             bool
+	flushDecider              func(written int64) FlushMode
+	autoFlush                 int
+	flushTypes                []string
+	originalLengthHeader      string
+	debugHeaders              bool
+	serverTiming              bool
+	etagMode                  ETagMode
+	http10                    HTTP10Mode
+	stripAcceptRanges         bool
+	maxDecompressed           int64
+	cache                     *responseCache
+	strictEncoding            bool
+	deadlineSlack             time.Duration
+	busy                      int
+	maxConcurrent             int
+	parallelGzip              int
+	spillDir                  string
+	spillLimit                int64
+	concurrentWait            time.Duration
+	sizeThreshold             int
+	smallLevel                int
+	largeLevel                int
+	overloaded                int
+	deflateDict               []byte
+	zstdFactory               CompressorFactory
+	zstdWindow                int
+
+	codings map[compType]int // preferences of the available codings
+	active  atomic.Int64     // number of responses being compressed, see WithAdaptiveLevel
+	slots   chan struct{}    // semaphore of WithMaxConcurrent
+
+	logger       Logger
+	errorHandler func(*http.Request, error)
+	stats        func(Stats)
+}
+
+func newConfig(level int, opts []Option) *config {
+	cfg := &config{
+		level:          level,
+		minLength:      CompressMinLength,
+		maxBuf:         CompressMaxBuf,
+		compressStatus: isCompressableStatus,
+		flushTypes:     defaultFlushTypes,
+		logger:         stdLogger{},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	cfg.codings = registeredCodings()
+	if cfg.maxConcurrent > 0 {
+		cfg.slots = make(chan struct{}, cfg.maxConcurrent)
+	}
+	if _, ok := cfg.codings[compZstd]; cfg.zstdFactory != nil && !ok {
+		cfg.codings[compZstd] = zstdPreference
+	}
+	return cfg
+}
+
+// validate checks the settings for invalid values
+func (cfg *config) validate() error {
+	if err := cfg.validateCodingLevels(); err != nil {
+		return err
+	}
+	if err := validateMediaTypes(append(append(cfg.types, cfg.excludedTypes...), cfg.flushTypes...)); err != nil {
+		return err
+	}
+	switch {
+	case cfg.minLength < 0:
+		return errors.Errorf("negative minimum length %d", cfg.minLength)
+	case cfg.maxBuf < cfg.minLength:
+		return errors.Errorf("buffer size %d smaller than minimum length %d", cfg.maxBuf, cfg.minLength)
+	case cfg.compressStatus == nil:
+		return errors.New("nil status code predicate")
+	case cfg.zstdWindow != 0 && (cfg.zstdWindow < zstd.MinWindowSize ||
+		cfg.zstdWindow > zstd.MaxWindowSize ||
+		cfg.zstdWindow&(cfg.zstdWindow-1) != 0):
+		return errors.Errorf("zstd window size %d is not a power of 2 in [%d, %d]",
+			cfg.zstdWindow, zstd.MinWindowSize, zstd.MaxWindowSize)
+	case cfg.minRatio < 0:
+		return errors.Errorf("negative minimum ratio %v", cfg.minRatio)
+	case cfg.cache != nil && cfg.cache.budget < 0:
+		return errors.Errorf("negative cache budget %d", cfg.cache.budget)
+	case cfg.maxDecompressed < 0:
+		return errors.Errorf("negative maximum decompressed body size %d", cfg.maxDecompressed)
+	case cfg.padding < 0 || cfg.padding > 0xffff-4:
+		return errors.Errorf("random padding %d out of range [0, %d]", cfg.padding, 0xffff-4)
+	case cfg.padding > 0 && cfg.deterministicGzip:
+		return errors.New("random padding contradicts deterministic gzip output")
+	case hasNilRegexp(cfg.excludePaths.regexps) || hasNilRegexp(cfg.includePaths.regexps):
+		return errors.New("nil path regexp")
+	case cfg.sizeThreshold > 0 && (cfg.smallLevel < flate.BestSpeed || cfg.smallLevel > flate.BestCompression ||
+		cfg.largeLevel < flate.BestSpeed || cfg.largeLevel > flate.BestCompression):
+		return errors.Errorf("compression levels %d, %d by size out of range [%d, %d]",
+			cfg.smallLevel, cfg.largeLevel, flate.BestSpeed, flate.BestCompression)
+	case cfg.spillLimit < 0:
+		return errors.Errorf("negative spill limit %d", cfg.spillLimit)
+	case cfg.parallelGzip < 0:
+		return errors.Errorf("negative parallel gzip threshold %d", cfg.parallelGzip)
+	case cfg.maxConcurrent < 0:
+		return errors.Errorf("negative maximum of concurrent compressions %d", cfg.maxConcurrent)
+	case cfg.concurrentWait < 0:
+		return errors.Errorf("negative wait for a compression slot %v", cfg.concurrentWait)
+	case cfg.busy < 0 || cfg.overloaded < 0:
+		return errors.Errorf("negative load limits %d, %d", cfg.busy, cfg.overloaded)
+	case cfg.overloaded > 0 && cfg.overloaded < cfg.busy:
+		return errors.Errorf("overload limit %d below busy limit %d", cfg.overloaded, cfg.busy)
+	case cfg.autoFlush < 0:
+		return errors.Errorf("negative auto flush size %d", cfg.autoFlush)
+	case cfg.logger == nil:
+		return errors.New("nil logger")
+	}
+	return nil
+}
+
+// levelRanges holds the valid compression levels of the codings
+var levelRanges = map[string][2]int{
+	hdrContentEncodingGzip:    {flate.HuffmanOnly, flate.BestCompression},
+	hdrContentEncodingDeflate: {flate.HuffmanOnly, flate.BestCompression},
+	hdrContentEncodingZstd:    {1, 22},
+	hdrContentEncodingBrotli:  {brotli.BestSpeed, brotli.BestCompression},
+}
+
+// defaultCodingLevels holds speed oriented levels for codings whose own
+// default is too expensive for dynamic responses. They apply as long as
+// neither the general level nor the level of the coding is set.
+var defaultCodingLevels = map[string]int{
+	hdrContentEncodingZstd:   3,
+	hdrContentEncodingBrotli: 4,
+}
+
+// validateMediaTypes checks the patterns of WithCompressableTypes and
+// WithExcludedTypes
+func validateMediaTypes(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Wrapf(err, "invalid media type pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// validateCodingLevels checks the level every available coding ends up with,
+// be it its own or the general one
+func (cfg *config) validateCodingLevels() error {
+	for coding := range cfg.codingLevels {
+		if _, ok := cfg.codings[compType(coding)]; !ok {
+			return errors.Errorf("compression level for unavailable coding %q", coding)
+		}
+	}
+	available := make([]string, 0, len(cfg.codings))
+	for c := range cfg.codings {
+		available = append(available, c.String())
+	}
+	sort.Strings(available)
+	for _, coding := range available {
+		r, ok := levelRanges[coding]
+		if !ok {
+			// the range of custom codings is unknown
+			continue
+		}
+		if level := cfg.levelFor(compType(coding)); level < r[0] || level > r[1] {
+			return errors.Errorf("compression level %d out of range [%d, %d] for %s",
+				level, r[0], r[1], coding)
+		}
+	}
+	return nil
+}
+
+// isCompressableStatus reports whether responses with the status code may
+// carry a body worth compressing. Redirects are left alone, as their bodies
+// are rarely more than a link.
+func isCompressableStatus(code int) bool {
+	return code >= 200 && code < 300 || code >= 400 && code < 600
+}
+
+// bufferThreshold returns the size up to which uncompressed content is
+// buffered
+func (cfg *config) bufferThreshold() int {
+	if cfg.threshold > 0 && cfg.threshold < cfg.maxBuf {
+		return cfg.threshold
+	}
+	return cfg.maxBuf
+}
+
+// getCompressor opens a compressor of type c configured by cfg
+func (cfg *config) getCompressor(c compType, w io.Writer, level int) (WriteCloseFlusher, error) {
+	if c == compZstd && cfg.zstdFactory != nil {
+		comp, err := cfg.zstdFactory(w, level)
+		return comp, errors.Wrap(err, "Opening compressor failed")
+	}
+	if c == compZstd && cfg.zstdWindow != 0 {
+		comp, err := newZstdWriterWindow(w, level, cfg.zstdWindow)
+		return comp, errors.Wrap(err, "Opening compressor failed")
+	}
+	return getCompressor(c, w, level, cfg.deflateDict)
+}
+
+// levelFor returns the compression level for compressors of type c
+func (cfg *config) levelFor(c compType) int {
+	if level, ok := cfg.codingLevels[c.String()]; ok {
+		return level
+	}
+	if level, ok := defaultCodingLevels[c.String()]; ok && cfg.level == flate.DefaultCompression {
+		return level
+	}
+	return cfg.level
+}
+
+// levelForSize returns the compression level for compressors of type c and
+// content of the given size, or -1 if unknown. See WithLevelBySize.
+func (cfg *config) levelForSize(c compType, size int) int {
+	if _, ok := cfg.codingLevels[c.String()]; ok || cfg.sizeThreshold <= 0 {
+		return cfg.levelFor(c)
+	}
+	if size >= 0 && size < cfg.sizeThreshold {
+		return cfg.smallLevel
+	}
+	return cfg.largeLevel
+}
+
+// nearDeadline reports whether the deadline of ctx is closer than the
+// configured slack
+func (cfg *config) nearDeadline(ctx context.Context) bool {
+	if cfg.deadlineSlack <= 0 || ctx == nil {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && time.Until(deadline) < cfg.deadlineSlack
+}
+
+// isBusy reports whether so many responses are compressed at the moment, that
+// flate.BestSpeed should be used, see WithAdaptiveLevel
+func (cfg *config) isBusy() bool {
+	return cfg.busy > 0 && cfg.active.Load() > int64(cfg.busy)
+}
+
+// countsActive reports whether the responses being compressed are counted
+func (cfg *config) countsActive() bool {
+	return cfg.busy > 0 || cfg.overloaded > 0
+}
+
+// isOverloaded reports whether so many responses are compressed at the moment,
+// that no more should be, see WithAdaptiveLevel
+func (cfg *config) isOverloaded() bool {
+	return cfg.overloaded > 0 && cfg.active.Load() >= int64(cfg.overloaded)
+}
+
+// handleError reports errors that occurred while finishing a response
+func (cfg *config) handleError(r *http.Request, err error) {
+	if cfg.errorHandler != nil {
+		cfg.errorHandler(r, err)
+		return
+	}
+	cfg.logger.Printf("%v", err)
+}
+
+// WithLevel sets the compression level of all codings. See compress/flate.
+// Without it, gzip and deflate use flate.DefaultCompression, zstd level 3
+// and brotli quality 4. The level has to be valid for every available coding
+// without a level of its own, see WithCodingLevel.
+func WithLevel(level int) Option {
+	return func(cfg *config) {
+		cfg.level = level
+	}
+}
+
+// WithMinLength sets the lower bound for compression. Smaller responses won't
+// be compressed. Defaults to CompressMinLength.
+func WithMinLength(n int) Option {
+	return func(cfg *config) {
+		cfg.minLength = n
+	}
+}
+
+// WithMaxBuf sets the upper bound for buffered compression. Larger responses
+// will be compressed on-the-fly. Defaults to CompressMaxBuf.
+func WithMaxBuf(n int) Option {
+	return func(cfg *config) {
+		cfg.maxBuf = n
+	}
+}
+
+// WithCodingLevel sets the compression level for a single coding, overriding
+// the general level, e.g. to use a different scale for zstd:
+//
+//	compress.New(h,
+//		compress.WithCodingLevel("gzip", 6),
+//		compress.WithCodingLevel("br", 4),
+//		compress.WithCodingLevel("zstd", 3))
+func WithCodingLevel(coding string, level int) Option {
+	return func(cfg *config) {
+		if cfg.codingLevels == nil {
+			cfg.codingLevels = make(map[string]int)
+		}
+		cfg.codingLevels[strings.ToLower(coding)] = level
+	}
+}
+
+// WithCompressStatus sets the status codes of responses that are compressed.
+// Defaults to all 2xx, 4xx and 5xx codes. This allows to also compress e.g.
+// large redirect bodies or to restrict compression to http.StatusOK.
+// Responses with status 204 or 304 are never compressed, as they have no
+// body.
+func WithCompressStatus(codes ...int) Option {
+	set := make(map[int]bool, len(codes))
+	for _, code := range codes {
+		set[code] = true
+	}
+	return WithCompressStatusFunc(func(code int) bool {
+		return set[code]
+	})
+}
+
+// WithCompressStatusFunc is like WithCompressStatus, but decides by calling f.
+func WithCompressStatusFunc(f func(code int) bool) Option {
+	return func(cfg *config) {
+		cfg.compressStatus = f
+	}
+}
+
+// WithCompressIfContentLanguage treats every response that carries a
+// Content-Language header as compressable text, even if its Content-Type is
+// not known to be compressable. Useful for localized HTML with unreliable
+// Content-Types.
+func WithCompressIfContentLanguage(enable bool) Option {
+	return func(cfg *config) {
+		cfg.compressIfContentLanguage = enable
+	}
+}
+
+// WithCompressableTypes replaces the list of compressed media types. Patterns
+// are either exact types, prefixes like "text/*", "*/*" for all types or glob
+// patterns like "application/*+json". The default list covers text, JSON,
+// XML, JavaScript, SVG, WebAssembly and uncompressed fonts.
+func WithCompressableTypes(patterns ...string) Option {
+	return func(cfg *config) {
+		cfg.types = append([]string{}, patterns...)
+	}
+}
+
+// WithExcludedTypes prevents compression of the given media types, even if
+// they match the list of compressed types. The patterns are the same as for
+// WithCompressableTypes.
+func WithExcludedTypes(patterns ...string) Option {
+	return func(cfg *config) {
+		cfg.excludedTypes = append(cfg.excludedTypes, patterns...)
+	}
+}
+
+// WithEntropySniffing looks at the first few KB of buffered responses and
+// sends them uncompressed, if they look compressed already, e.g. images with a
+// wrong Content-Type. Additionally, application/octet-stream responses are
+// compressed, if they don't. Streamed responses are not sniffed.
+func WithEntropySniffing(enable bool) Option {
+	return func(cfg *config) {
+		cfg.sniffEntropy = enable
+	}
+}
+
+// WithSkipSensitive leaves responses uncompressed that likely contain
+// secrets, i.e. responses setting cookies and responses to requests with
+// Authorization. Compressing secrets together with content an attacker can
+// influence leaks them through the compressed length, see BREACH.
+func WithSkipSensitive(enable bool) Option {
+	return func(cfg *config) {
+		cfg.skipSensitive = enable
+	}
+}
+
+// WithRandomPadding adds up to max bytes of random length padding to gzip
+// responses, using the extra field of the gzip header. This blunts length
+// oracles like BREACH, but doesn't prevent them. Other codings are not
+// padded.
+func WithRandomPadding(max int) Option {
+	return func(cfg *config) {
+		cfg.padding = max
+	}
+}
+
+// WithDeterministicGzip makes gzip responses byte-identical for identical
+// content by zeroing the modification time and OS fields of the gzip header,
+// so caches comparing compressed bodies see the same representation. It
+// can't be combined with WithRandomPadding.
+func WithDeterministicGzip(enable bool) Option {
+	return func(cfg *config) {
+		cfg.deterministicGzip = enable
+	}
+}
+
+// WithExcludePaths disables compression for requests of the exact paths, e.g.
+// "/metrics" or "/healthz".
+func WithExcludePaths(paths ...string) Option {
+	return func(cfg *config) {
+		cfg.excludePaths.addExact(paths)
+	}
+}
+
+// WithExcludePrefix disables compression for requests of paths starting with
+// any of the prefixes.
+func WithExcludePrefix(prefixes ...string) Option {
+	return func(cfg *config) {
+		cfg.excludePaths.prefixes = append(cfg.excludePaths.prefixes, prefixes...)
+	}
+}
+
+// WithExcludeRegexp disables compression for requests of paths matching re.
+func WithExcludeRegexp(re *regexp.Regexp) Option {
+	return func(cfg *config) {
+		cfg.excludePaths.regexps = append(cfg.excludePaths.regexps, re)
+	}
+}
+
+// WithIncludePaths restricts compression to requests of the exact paths and
+// the paths of the other include options. Excluded paths are never
+// compressed.
+func WithIncludePaths(paths ...string) Option {
+	return func(cfg *config) {
+		cfg.includePaths.addExact(paths)
+	}
+}
+
+// WithIncludePrefix restricts compression to requests of paths starting with
+// any of the prefixes, e.g. "/api/", and the paths of the other include
+// options.
+func WithIncludePrefix(prefixes ...string) Option {
+	return func(cfg *config) {
+		cfg.includePaths.prefixes = append(cfg.includePaths.prefixes, prefixes...)
+	}
+}
+
+// WithIncludeRegexp restricts compression to requests of paths matching re
+// and the paths of the other include options.
+func WithIncludeRegexp(re *regexp.Regexp) Option {
+	return func(cfg *config) {
+		cfg.includePaths.regexps = append(cfg.includePaths.regexps, re)
+	}
+}
+
+// WithShouldCompress adds a predicate that has to agree for a response to be
+// compressed, after all other checks passed. It is called with the status
+// code and the headers set by the handler, e.g. to skip responses carrying
+// secrets like CSRF tokens:
+//
+//	compress.WithShouldCompress(func(code int, hdr http.Header, r *http.Request) bool {
+//		return hdr.Get("X-CSRF-Token") == ""
+//	})
+func WithShouldCompress(f func(code int, hdr http.Header, r *http.Request) bool) Option {
+	return func(cfg *config) {
+		cfg.shouldCompress = f
+	}
+}
+
+// WithDeflateDictionary sets a preset dictionary for the deflate coding. This
+// can improve the compression ratio a lot for small and repetitive responses.
+// Clients have to use the same dictionary to decompress the responses, see
+// flate.NewReaderDict. The dictionary is never applied to gzip, nor to a
+// deflate compressor registered via RegisterCoding; its output decompresses
+// with the dictionary all the same.
+func WithDeflateDictionary(dict []byte) Option {
+	return func(cfg *config) {
+		cfg.deflateDict = dict
+	}
+}
+
+// WithLogger sets the Logger used to report problems. Defaults to the standard
+// logger of package log. The Logger receives problems the middleware recovers
+// from, like compressors that fail and fall back to uncompressed content or
+// superfluous WriteHeader calls. Failures to finish a response go to the
+// error handler, see WithErrorHandler.
+func WithLogger(l Logger) Option {
+	return func(cfg *config) {
+		cfg.logger = l
+	}
+}
+
+// WithErrorHandler sets a callback that is invoked with the original request
+// whenever finishing a compressed response fails, e.g. to count errors in a
+// metric. It replaces the default of logging the error via the Logger.
+// The callback is also invoked if the wrapped handler panics.
+func WithErrorHandler(f func(*http.Request, error)) Option {
+	return func(cfg *config) {
+		cfg.errorHandler = f
+	}
+}
+
+// WithStats sets a callback that is invoked with the Stats of every response
+// once it is finished, e.g. to enrich access logs. Responses skipped before
+// the handler is called, like for excluded paths or clients without a common
+// coding, are not reported.
+func WithStats(f func(Stats)) Option {
+	return func(cfg *config) {
+		cfg.stats = f
+	}
+}
+
+// zstdPreference is the preference of zstd when enabled via WithZstd, see
+// RegisterCoding
+const zstdPreference = 3
+
+// WithZstd replaces the built-in zstd implementation, using factory to create
+// the compressors. This also enables zstd, if it was unregistered. The
+// preference of a registered zstd is kept, otherwise zstd is preferred over
+// gzip and deflate on equal quality values.
+func WithZstd(factory CompressorFactory) Option {
+	return func(cfg *config) {
+		cfg.zstdFactory = factory
+	}
+}
+
+// WithRespectPreferHeader makes the middleware honor the nonstandard
+// "Prefer: no-compression" request header. The preference is removed from the
+// request before it is passed on and the response is left uncompressed.
+func WithRespectPreferHeader(enable bool) Option {
+	return func(cfg *config) {
+		cfg.respectPrefer = enable
+	}
+}
+
+// WithRespectNoTransform controls whether responses with Cache-Control:
+// no-transform are passed through uncompressed, as RFC 9111 demands from
+// intermediaries. Enabled by default. Disable it if the middleware is
+// considered part of the origin server.
+func WithRespectNoTransform(enable bool) Option {
+	return func(cfg *config) {
+		cfg.ignoreNoTransform = !enable
+	}
+}
+
+// WithBufferThreshold sets the size up to which uncompressed content is
+// buffered before committing to compression. Larger content is compressed into
+// the buffer, until the compressed content exceeds the buffer size, which then
+// is streamed. This allows to send even large responses with Content-Length,
+// but spares buffering most uncompressed content. Defaults to the buffer size,
+// i.e. content is streamed as soon as the buffer is full.
+func WithBufferThreshold(n int) Option {
+	return func(cfg *config) {
+		cfg.threshold = n
+	}
+}
+
+// WithNoBuffering disables buffering, so all compressed responses are
+// streamed without Content-Length. This minimizes latency and memory usage,
+// e.g. behind a proxy that buffers responses anyway. Only the first bytes up
+// to the minimum length are held back, so short responses are still sent
+// uncompressed.
+func WithNoBuffering() Option {
+	return func(cfg *config) {
+		cfg.noBuffering = true
+	}
+}
+
+// WithMinRatio sets the largest acceptable ratio of compressed to
+// uncompressed size. If the compressed content turns out to be larger, the
+// response is sent uncompressed instead, e.g. a ratio of 0.9 requires the
+// compression to save at least 10%. This only works for responses that fit
+// into the buffer, streamed responses are always compressed. Buffered
+// responses that don't get smaller at all are always sent uncompressed.
+func WithMinRatio(ratio float64) Option {
+	return func(cfg *config) {
+		cfg.minRatio = ratio
+	}
+}
+
+// WithDigestTrailer adds a "Digest: sha-256=..." trailer to compressed
+// responses, calculated over the compressed content. As trailers require a
+// chunked body, these responses are always streamed.
+func WithDigestTrailer(enable bool) Option {
+	return func(cfg *config) {
+		cfg.digestTrailer = enable
+	}
+}
+
+// WithFlushDecider sets a function that is called after every write to a
+// streamed response with the total number of uncompressed bytes written so far
+// and decides how to flush the compressor. Buffered responses are not
+// affected.
+func WithFlushDecider(f func(written int64) FlushMode) Option {
+	return func(cfg *config) {
+		cfg.flushDecider = f
+	}
+}
+
+// WithAutoFlush flushes streamed responses whenever n uncompressed bytes were
+// written since the last flush. This bounds the latency of long-lived
+// streaming responses at the cost of a slightly worse compression ratio.
+func WithAutoFlush(n int) Option {
+	return func(cfg *config) {
+		cfg.autoFlush = n
+	}
+}
+
+// defaultFlushTypes are the media types of streams of events
+var defaultFlushTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+}
+
+// WithFlushTypes sets the media types of responses that are streamed and
+// flushed after every write, so events reach the client without delay.
+// Patterns are the same as for WithCompressableTypes. Defaults to
+// text/event-stream and application/x-ndjson. Calling it without patterns
+// disables flushing by type.
+func WithFlushTypes(patterns ...string) Option {
+	return func(cfg *config) {
+		cfg.flushTypes = append([]string{}, patterns...)
+	}
+}
+
+// WithOriginalLengthHeader copies the Content-Length announced by the handler
+// to the header name, e.g. "X-Original-Content-Length", whenever a response is
+// compressed. This allows observers to see the uncompressed size.
+func WithOriginalLengthHeader(name string) Option {
+	return func(cfg *config) {
+		cfg.originalLengthHeader = name
+	}
+}
+
+// WithServerTiming appends an entry like `compress;dur=1.234;desc="gzip"` to the
+// Server-Timing header of compressed responses, with the time spent
+// compressing in milliseconds. Streamed responses get it as a trailer, which
+// not every client shows.
+func WithServerTiming() Option {
+	return func(cfg *config) {
+		cfg.serverTiming = true
+	}
+}
+
+// WithDebugHeaders adds headers describing the compression to each response,
+// to check it in the browser's developer tools. Compressed responses get
+// X-Compress-Encoder with the coding and level and, if the size is known,
+// X-Compress-Original-Length and X-Compress-Ratio. Uncompressed ones get
+// X-Compress-Skipped with the reason, see the Skip constants. Not meant for
+// production, as it reveals the size of the content.
+func WithDebugHeaders() Option {
+	return func(cfg *config) {
+		cfg.debugHeaders = true
+	}
+}
+
+// ETagMode selects how the ETag of compressed responses is changed
+type ETagMode int
+
+// Supported ETag modes
+const (
+	// ETagKeep passes the ETag set by the handler through unchanged
+	ETagKeep ETagMode = iota
+	// ETagWeaken turns a strong ETag into a weak one, e.g. "abc" into
+	// W/"abc"
+	ETagWeaken
+	// ETagSuffix appends the coding to the ETag, e.g. "abc" becomes
+	// "abc-gzip"
+	ETagSuffix
+)
+
+// WithETag sets how the ETag of compressed responses is changed. The
+// compressed bytes differ from the uncompressed ones, so a strong ETag must
+// not be shared by both representations. Defaults to ETagKeep.
+func WithETag(mode ETagMode) Option {
+	return func(cfg *config) {
+		cfg.etagMode = mode
+	}
+}
+
+// HTTP10Mode selects how responses to HTTP/1.0 requests are compressed. Those
+// clients can't receive chunked responses, so a response without
+// Content-Length can only end by closing the connection.
+type HTTP10Mode int
+
+// Supported HTTP/1.0 modes
+const (
+	// HTTP10Stream treats HTTP/1.0 like any other request. Large responses
+	// are streamed and end by closing the connection.
+	HTTP10Stream HTTP10Mode = iota
+	// HTTP10Buffer buffers the complete compressed content in memory to
+	// send it with a Content-Length, unless the handler flushes.
+	HTTP10Buffer
+	// HTTP10Skip sends responses to HTTP/1.0 requests uncompressed
+	HTTP10Skip
+)
+
+// WithHTTP10 sets how responses to HTTP/1.0 requests are compressed. Defaults
+// to HTTP10Stream.
+func WithHTTP10(mode HTTP10Mode) Option {
+	return func(cfg *config) {
+		cfg.http10 = mode
+	}
+}
+
+// WithStripAcceptRanges removes the Accept-Ranges header from compressed
+// responses. Partial responses are never compressed, as their ranges refer to
+// the uncompressed content, so clients resuming a compressed download would
+// receive a different representation.
+func WithStripAcceptRanges(enable bool) Option {
+	return func(cfg *config) {
+		cfg.stripAcceptRanges = enable
+	}
+}
+
+// WithCache keeps the compressed content of up to budget bytes of responses
+// in memory. Responses to GET requests carrying an ETag or Last-Modified
+// header are stored per URL, coding and validator. If the handler responds
+// with the same validator again, the stored content is sent instead of
+// compressing the content of the handler once more. Only responses that fit
+// into the buffer are cached.
+//
+// The handler still runs on every hit and its content is discarded, so only
+// the compression is saved. Handlers that are expensive to run should answer
+// conditional requests themselves, e.g. with http.ServeContent.
+func WithCache(budget int64) Option {
+	return func(cfg *config) {
+		cfg.cache = newResponseCache(budget)
+	}
+}
+
+// WithMaxDecompressedBody limits the size of decompressed request bodies for
+// Decompress and NewRequestDecompressor to guard against decompression bombs.
+// Reading beyond the limit fails with *http.MaxBytesError and the request is
+// answered with 413 Content Too Large, unless the handler already started its
+// response. Zero means no limit.
+func WithMaxDecompressedBody(n int64) Option {
+	return func(cfg *config) {
+		cfg.maxDecompressed = n
+	}
+}
+
+// WithStrictContentEncoding makes the middleware verify responses, for which
+// the handler already set a Content-Encoding that is supported by this package.
+// By default such responses are passed through untouched, as the handler is
+// expected to have encoded the content itself. In strict mode, content that
+// doesn't start with the signature of the announced coding is refused with an
+// error instead, catching handlers that expect the middleware to do the
+// encoding. Deflate has no signature and can't be verified.
+func WithStrictContentEncoding(enable bool) Option {
+	return func(cfg *config) {
+		cfg.strictEncoding = enable
+	}
+}
+
+// WithDeadlineGuard makes the middleware use flate.BestSpeed instead of the
+// configured level, if less than slack remains until the deadline of the
+// request context. Spending a lot of time on compression could otherwise
+// push the request over its deadline.
+func WithDeadlineGuard(slack time.Duration) Option {
+	return func(cfg *config) {
+		cfg.deadlineSlack = slack
+	}
+}
+
+// WithLevelBySize picks the compression level by the size of the response.
+// Small responses gain little from expensive compression but pay its latency.
+// Responses shorter than threshold bytes, according to their Content-Length
+// or the buffered content, are compressed with the small level. All others,
+// including streamed responses of unknown size, with the large one. Both
+// levels have to be in [flate.BestSpeed, flate.BestCompression] and replace the
+// general level for all codings without a level of their own, see
+// WithCodingLevel.
+func WithLevelBySize(threshold, small, large int) Option {
+	return func(cfg *config) {
+		cfg.sizeThreshold = threshold
+		cfg.smallLevel = small
+		cfg.largeLevel = large
+	}
+}
+
+// WithAdaptiveLevel protects the CPU during traffic spikes. While more than
+// busy responses are compressed at the same time, flate.BestSpeed is used
+// instead of the configured level. Once overloaded responses are compressed,
+// further ones are sent uncompressed. 0 disables either limit.
+func WithAdaptiveLevel(busy, overloaded int) Option {
+	return func(cfg *config) {
+		cfg.busy = busy
+		cfg.overloaded = overloaded
+	}
+}
+
+// WithSpillToDisk keeps buffering compressed content beyond the buffer size
+// in a temporary file in dir, or os.TempDir if empty, until it exceeds limit
+// bytes. This way even large responses are sent with a Content-Length instead
+// of chunked, as some clients and HTTP/1.0 need. The file is removed once the
+// response is finished.
+func WithSpillToDisk(dir string, limit int64) Option {
+	return func(cfg *config) {
+		cfg.spillDir = dir
+		cfg.spillLimit = limit
+	}
+}
+
+// WithParallelGzip compresses gzip responses with a Content-Length of at least
+// threshold bytes on all CPUs. The content is split into blocks of 1 MiB that
+// are compressed in parallel, which speeds up multi-megabyte responses a lot.
+// It does not apply together with WithRandomPadding. 0 disables it.
+func WithParallelGzip(threshold int) Option {
+	return func(cfg *config) {
+		cfg.parallelGzip = threshold
+	}
+}
+
+// WithMaxConcurrent bounds the number of responses compressed at the same
+// time to n, e.g. to keep brotli or zstd at high levels from hogging the CPU.
+// Further responses wait up to wait for one of them to finish and are sent
+// uncompressed if none does. 0 disables the limit.
+func WithMaxConcurrent(n int, wait time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxConcurrent = n
+		cfg.concurrentWait = wait
+	}
+}
+
+// WithZstdWindowSize sets the window size of the built-in zstd compressor. It
+// has to be a power of 2 between zstd.MinWindowSize and zstd.MaxWindowSize.
+// Smaller windows reduce the memory needed by clients to decompress.
+func WithZstdWindowSize(size int) Option {
+	return func(cfg *config) {
+		cfg.zstdWindow = size
+	}
+}
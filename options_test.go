@@ -0,0 +1,1313 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// handlerWith returns a handler writing content with the header fields in
+// kv, given as key/value pairs
+func handlerWith(content string, kv ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i+1 < len(kv); i += 2 {
+			w.Header().Set(kv[i], kv[i+1])
+		}
+		io.WriteString(w, content)
+	})
+}
+
+func TestCompressIfContentLanguage(t *testing.T) {
+	content := strings.Repeat("Bonjour tout le monde! ", 100)
+	for _, enable := range []bool{false, true} {
+		h := New(handlerWith(content,
+			hdrContentType, "application/x-localized",
+			hdrContentLanguage, "fr"),
+			WithCompressIfContentLanguage(enable))
+		rec := get(h, "gzip")
+		want := ""
+		if enable {
+			want = "gzip"
+		}
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != want {
+			t.Errorf("%v: Content-Encoding %q", enable, ce)
+		}
+		if got := decode(t, want, rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%v: got %d bytes", enable, len(got))
+		}
+	}
+}
+
+func TestDeflateDictionary(t *testing.T) {
+	dict := []byte(`{"id":0,"type":"message","text":""}`)
+	content := strings.Repeat(`{"id":1,"type":"message","text":"hi"}`, 20)
+	h := New(handlerWith(content, hdrContentType, "text/plain"),
+		WithDeflateDictionary(dict))
+
+	rec := get(h, "deflate")
+	if ce := rec.Result().Header.Get(hdrContentEncoding); ce != "deflate" {
+		t.Fatalf("Content-Encoding %q", ce)
+	}
+	got, err := io.ReadAll(flate.NewReaderDict(bytes.NewReader(rec.Body.Bytes()), dict))
+	if err != nil || string(got) != content {
+		t.Errorf("got %q, %v", got, err)
+	}
+
+	// gzip has no preset dictionary
+	rec = get(h, "gzip")
+	if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != content {
+		t.Errorf("gzip: got %q", got)
+	}
+
+	// A registered deflate factory is used without the dictionary
+	builtin, _ := lookupCoding(compDeflate)
+	var calls int
+	RegisterCoding("deflate", func(w io.Writer, level int) (WriteCloseFlusher, error) {
+		calls++
+		return flate.NewWriter(w, level)
+	}, builtin.preference)
+	t.Cleanup(func() {
+		codingsMu.Lock()
+		defer codingsMu.Unlock()
+		codings[compDeflate] = builtin
+	})
+	h = New(handlerWith(content, hdrContentType, "text/plain"),
+		WithDeflateDictionary(dict))
+	rec = get(h, "deflate")
+	if calls != 1 {
+		t.Errorf("registered factory called %d times", calls)
+	}
+	got, err = io.ReadAll(flate.NewReaderDict(bytes.NewReader(rec.Body.Bytes()), dict))
+	if err != nil || string(got) != content {
+		t.Errorf("registered: got %q, %v", got, err)
+	}
+}
+
+// brokenWriter is a ResponseWriter whose connection fails on every Write
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (brokenWriter) Write(p []byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestErrorHandler(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, panics := range []bool{false, true} {
+		var calls int
+		var errReq *http.Request
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			io.WriteString(w, content)
+			if panics {
+				panic("handler failed")
+			}
+		}), WithErrorHandler(func(r *http.Request, err error) {
+			calls++
+			errReq = r
+		}))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		func() {
+			defer func() {
+				if r := recover(); (r != nil) != panics {
+					t.Errorf("panic %v", r)
+				}
+			}()
+			h.ServeHTTP(brokenWriter{httptest.NewRecorder()}, req)
+		}()
+		if calls != 1 {
+			t.Errorf("panics %v: error handler called %d times", panics, calls)
+		}
+		if errReq != req {
+			t.Errorf("panics %v: error handler got another request", panics)
+		}
+	}
+}
+
+func TestZstdFactory(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	var calls int
+	factory := func(w io.Writer, level int) (WriteCloseFlusher, error) {
+		calls++
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	t.Cleanup(func() { RegisterCoding("zstd", newZstdWriter, zstdPreference) })
+	for _, tc := range []struct {
+		pref         int // preference registered for zstd, 0 keeps the default, -1 unregisters it
+		accept, want string
+	}{
+		{0, "zstd", "zstd"},
+		{0, "gzip;q=0.5, zstd", "zstd"},
+		{0, "gzip, zstd", "zstd"},
+		{0, "gzip, zstd;q=0.5", "gzip"},
+		{0, "br, zstd", "br"},
+		{5, "br, zstd", "zstd"},
+		{1, "gzip, zstd", "gzip"},
+		{-1, "gzip, zstd", "zstd"},
+		{-1, "br, zstd", "br"},
+	} {
+		switch tc.pref {
+		case 0:
+			RegisterCoding("zstd", newZstdWriter, zstdPreference)
+		case -1:
+			unregisterCoding("zstd")
+		default:
+			RegisterCoding("zstd", newZstdWriter, tc.pref)
+		}
+		h := New(handlerWith(content, hdrContentType, "text/plain"), WithZstd(factory))
+		calls = 0
+		rec := get(h, tc.accept)
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%d %s: Content-Encoding %q", tc.pref, tc.accept, ce)
+		}
+		if got := decode(t, tc.want, rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%d %s: got %d bytes", tc.pref, tc.accept, len(got))
+		}
+		if want := tc.want == "zstd"; (calls == 1) != want {
+			t.Errorf("%d %s: factory called %d times", tc.pref, tc.accept, calls)
+		}
+	}
+}
+
+func TestMediaTypeParameters(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, ctype string
+		want           bool
+	}{
+		{"text/html", "text/html; charset=utf-8", true},
+		{"text/html", "TEXT/HTML;charset=UTF-8", true},
+		{"text/html", "text/html ; charset=\"utf-8\"", true},
+		{"text/html", "text/htmlx; charset=utf-8", false},
+		{"text/*", "text/css; charset=utf-8", true},
+		{"text/*", "text; charset=utf-8", false},
+		{"multipart/mixed", "multipart/mixed; boundary=frontier", true},
+		{"application/*+json", "application/ld+json; charset=utf-8; profile=x", true},
+		{"application/*+json", "application/json; charset=utf-8", false},
+		{"application/json", "application/json; charset", true},
+	} {
+		hdr := http.Header{hdrContentType: {tc.ctype}}
+		cfg := newConfig(flate.DefaultCompression, []Option{WithCompressableTypes(tc.pattern)})
+		if got := isCompressableType(cfg, hdr); got != tc.want {
+			t.Errorf("%s matching %q: got %v", tc.pattern, tc.ctype, got)
+		}
+		cfg = newConfig(flate.DefaultCompression, []Option{WithExcludedTypes(tc.pattern)})
+		if got := isCompressableType(cfg, hdr); got && tc.want {
+			t.Errorf("%s excluding %q: got %v", tc.pattern, tc.ctype, got)
+		}
+	}
+}
+
+func TestCompressRedirect(t *testing.T) {
+	body := "<html><body>" + strings.Repeat("<p>This page has moved.</p>\n", 50) + "</body></html>"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrContentType, "text/html; charset=utf-8")
+		w.Header().Set("Location", "/new")
+		w.WriteHeader(http.StatusMovedPermanently)
+		io.WriteString(w, body)
+	})
+	for _, tc := range []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"default", nil, ""},
+		{"3xx", []Option{WithCompressStatusFunc(func(code int) bool { return code < 400 })}, "gzip"},
+		{"301", []Option{WithCompressStatus(http.StatusMovedPermanently)}, "gzip"},
+		{"3xx, no html", []Option{WithCompressStatus(http.StatusMovedPermanently), WithCompressableTypes("application/json")}, ""},
+	} {
+		rec := get(New(handler, tc.opts...), "gzip")
+		if rec.Code != http.StatusMovedPermanently {
+			t.Errorf("%s: got status %d", tc.name, rec.Code)
+		}
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+		}
+		if got := decode(t, tc.want, rec.Body.Bytes()); string(got) != body {
+			t.Errorf("%s: got %d bytes", tc.name, len(got))
+		}
+	}
+}
+
+func TestResetDefaults(t *testing.T) {
+	defer ResetDefaults()
+	CompressMinLength = 1
+	CompressMaxBuf = 1
+	ResetDefaults()
+	if CompressMinLength != 256 || CompressMaxBuf != 16384 {
+		t.Errorf("got %d and %d", CompressMinLength, CompressMaxBuf)
+	}
+}
+
+func TestRespectPreferHeader(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	var prefer string
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefer = r.Header.Get(hdrPrefer)
+		w.Header().Set(hdrContentType, "text/plain")
+		io.WriteString(w, content)
+	}), WithRespectPreferHeader(true))
+	for _, tc := range []struct {
+		prefer, want, rest string
+	}{
+		{"", "gzip", ""},
+		{"respond-async", "gzip", "respond-async"},
+		{"no-compression", "", ""},
+		{"respond-async, No-Compression", "", "respond-async"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		if tc.prefer != "" {
+			req.Header.Set(hdrPrefer, tc.prefer)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%q: Content-Encoding %q", tc.prefer, ce)
+		}
+		if prefer != tc.rest {
+			t.Errorf("%q: handler got Prefer %q", tc.prefer, prefer)
+		}
+	}
+}
+
+func TestMinRatio(t *testing.T) {
+	// Hex encoded random bytes compress to a little more than half
+	raw := make([]byte, 2000)
+	rand.New(rand.NewSource(1)).Read(raw)
+	content := hex.EncodeToString(raw)
+	for _, tc := range []struct {
+		ratio float64
+		want  string
+	}{
+		{0, "gzip"},
+		{0.9, "gzip"},
+		{0.5, ""},
+	} {
+		h := New(handlerWith(content, hdrContentType, "text/plain"), WithMinRatio(tc.ratio))
+		rec := get(h, "gzip")
+		hdr := rec.Result().Header
+		if ce := hdr.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%v: Content-Encoding %q", tc.ratio, ce)
+		}
+		if tc.want == "" && (hdr.Get(hdrVary) != "" || hdr.Get(hdrContentLength) != strconv.Itoa(len(content))) {
+			t.Errorf("%v: Vary %q, Content-Length %q", tc.ratio, hdr.Get(hdrVary), hdr.Get(hdrContentLength))
+		}
+		if got := decode(t, tc.want, rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%v: got %d bytes", tc.ratio, len(got))
+		}
+	}
+}
+
+func TestDigestTrailer(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	h := New(handlerWith(content, hdrContentType, "text/plain"), WithDigestTrailer(true))
+	rec := get(h, "gzip")
+	res := rec.Result()
+	if ce := res.Header.Get(hdrContentEncoding); ce != "gzip" {
+		t.Errorf("Content-Encoding %q", ce)
+	}
+	if trailer := res.Header.Get(hdrTrailer); trailer != hdrDigest {
+		t.Errorf("Trailer %q", trailer)
+	}
+	sum := sha256.Sum256(rec.Body.Bytes())
+	if want := "sha-256=" + base64.StdEncoding.EncodeToString(sum[:]); res.Trailer.Get(hdrDigest) != want {
+		t.Errorf("Digest %q, want %q", res.Trailer.Get(hdrDigest), want)
+	}
+	if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != content {
+		t.Errorf("got %d bytes", len(got))
+	}
+
+	// Uncompressed responses don't announce the trailer
+	h = New(handlerWith("Hello", hdrContentType, "text/plain"), WithDigestTrailer(true))
+	if trailer := get(h, "gzip").Result().Header.Get(hdrTrailer); trailer != "" {
+		t.Errorf("uncompressed: Trailer %q", trailer)
+	}
+
+	// Nor do responses falling back to uncompressed after the announcement
+	failing := WithZstd(func(w io.Writer, level int) (WriteCloseFlusher, error) {
+		return nil, errors.New("no compressor")
+	})
+	h = New(handlerWith(content, hdrContentType, "text/plain"),
+		WithDigestTrailer(true), failing, WithLogger(&testLogger{}))
+	rec = get(h, "zstd")
+	res = rec.Result()
+	if trailer := res.Header.Get(hdrTrailer); trailer != "" || res.Trailer.Get(hdrDigest) != "" {
+		t.Errorf("fallback: Trailer %q, Digest %q", trailer, res.Trailer.Get(hdrDigest))
+	}
+	if rec.Body.String() != content {
+		t.Errorf("fallback: got %d bytes", rec.Body.Len())
+	}
+}
+
+// flushRecorder records the length of the body at each Flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []int
+}
+
+func (fr *flushRecorder) Flush() {
+	fr.flushed = append(fr.flushed, fr.Body.Len())
+	fr.ResponseRecorder.Flush()
+}
+
+func TestFlushDecider(t *testing.T) {
+	const segment = 1024
+	var content strings.Builder
+	for i := 0; content.Len() < 8*segment; i++ {
+		fmt.Fprintf(&content, "%-63d\n", i)
+	}
+
+	var modes []FlushMode
+	var written []int64
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrContentType, "text/plain")
+		for rest := content.String(); rest != ""; rest = rest[256:] {
+			io.WriteString(w, rest[:256])
+		}
+	}), WithNoBuffering(), WithFlushDecider(func(n int64) FlushMode {
+		mode := FlushSync
+		if n%segment == 0 {
+			mode = FlushFull
+		}
+		modes = append(modes, mode)
+		written = append(written, n)
+		return mode
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(hdrAcceptEncoding, "deflate")
+	rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(rec, req)
+
+	body := rec.Body.Bytes()
+	if got := decode(t, "deflate", body); string(got) != content.String() {
+		t.Fatalf("got %d bytes", len(got))
+	}
+	if len(rec.flushed) < len(modes) {
+		t.Fatalf("%d flushes for %d decisions", len(rec.flushed), len(modes))
+	}
+	var segments int
+	for i, mode := range modes {
+		if mode != FlushFull {
+			continue
+		}
+		// Everything after a full flush decodes without the preceding data
+		segments++
+		got, _ := io.ReadAll(flate.NewReader(bytes.NewReader(body[rec.flushed[i]:])))
+		if want := content.String()[written[i]:]; string(got) != want {
+			t.Errorf("segment at %d: got %d bytes, want %d", written[i], len(got), len(want))
+		}
+	}
+	if segments != 8 {
+		t.Errorf("got %d segments", segments)
+	}
+}
+
+func TestCompressStatus(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	all := WithCompressStatusFunc(func(code int) bool { return true })
+	for _, tc := range []struct {
+		code int
+		opts []Option
+		want string
+	}{
+		{http.StatusCreated, nil, "gzip"},
+		{http.StatusNotFound, nil, "gzip"},
+		{http.StatusInternalServerError, nil, "gzip"},
+		{http.StatusNotFound, []Option{WithCompressStatus(http.StatusOK)}, ""},
+		{http.StatusNoContent, []Option{all}, ""},
+		{http.StatusNotModified, []Option{all}, ""},
+		{http.StatusPartialContent, []Option{all}, ""},
+	} {
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			w.WriteHeader(tc.code)
+			io.WriteString(w, content)
+		}), tc.opts...)
+		rec := get(h, "gzip")
+		if rec.Code != tc.code {
+			t.Errorf("%d: got status %d", tc.code, rec.Code)
+		}
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%d: Content-Encoding %q", tc.code, ce)
+		}
+		if tc.want != "" {
+			if got := decode(t, tc.want, rec.Body.Bytes()); string(got) != content {
+				t.Errorf("%d: got %d bytes", tc.code, len(got))
+			}
+		}
+	}
+}
+
+func TestFailingFactory(t *testing.T) {
+	factory := func(w io.Writer, level int) (WriteCloseFlusher, error) {
+		return nil, errors.New("no compressor")
+	}
+	for _, content := range []string{
+		strings.Repeat("Hello, World! ", 100),   // buffered
+		strings.Repeat("Hello, World! ", 10000), // streamed
+	} {
+		var logger testLogger
+		h := New(handlerWith(content, hdrContentType, "text/plain"), WithZstd(factory), WithLogger(&logger))
+		rec := get(h, "zstd")
+		hdr := rec.Result().Header
+		if rec.Code != http.StatusOK {
+			t.Errorf("%d bytes: got status %d", len(content), rec.Code)
+		}
+		if hdr.Get(hdrContentEncoding) != "" || hdr.Get(hdrVary) != "" {
+			t.Errorf("%d bytes: Content-Encoding %q, Vary %q", len(content), hdr.Get(hdrContentEncoding), hdr.Get(hdrVary))
+		}
+		if rec.Body.String() != content {
+			t.Errorf("%d bytes: got %d bytes", len(content), rec.Body.Len())
+		}
+		if len(logger.msgs) == 0 {
+			t.Errorf("%d bytes: error not logged", len(content))
+		}
+	}
+}
+
+func TestAutoFlush(t *testing.T) {
+	// The first write overflows the buffer and starts streaming
+	chunks := []string{strings.Repeat("large ", 5000)}
+	for i := 0; i < 10; i++ {
+		chunks = append(chunks, fmt.Sprintf("%-299d\n", i))
+	}
+	rec := httptest.NewRecorder()
+	var written strings.Builder
+	var checked int
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrContentType, "text/plain")
+		for _, chunk := range chunks {
+			io.WriteString(w, chunk)
+			written.WriteString(chunk)
+
+			// Everything written so far can be decoded by the client
+			zr, err := gzip.NewReader(bytes.NewReader(rec.Body.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(zr)
+			if string(got) != written.String() {
+				t.Errorf("after %d bytes: decoded %d bytes", written.Len(), len(got))
+			}
+			checked++
+		}
+	}), WithAutoFlush(256))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(hdrAcceptEncoding, "gzip")
+	h.ServeHTTP(rec, req)
+	if checked != 11 {
+		t.Errorf("checked %d chunks", checked)
+	}
+	if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != written.String() {
+		t.Errorf("got %d bytes", len(got))
+	}
+}
+
+func TestOriginalLengthHeader(t *testing.T) {
+	const name = "X-Original-Content-Length"
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, tc := range []struct {
+		name     string
+		ctype    string
+		declared bool
+		want     string
+	}{
+		{"compressed", "text/plain", true, strconv.Itoa(len(content))},
+		{"unknown length", "text/plain", false, ""},
+		{"uncompressed", "image/png", true, ""},
+	} {
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, tc.ctype)
+			if tc.declared {
+				w.Header().Set(hdrContentLength, strconv.Itoa(len(content)))
+			}
+			io.WriteString(w, content)
+		}), WithOriginalLengthHeader(name))
+		hdr := get(h, "gzip").Result().Header
+		if got := hdr.Get(name); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestStrictContentEncoding(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, tc := range []struct {
+		name    string
+		strict  bool
+		body    []byte
+		wantErr bool
+	}{
+		{"pass-through plain", false, []byte(content), false},
+		{"pass-through gzip", false, encode(t, "gzip", []byte(content)), false},
+		{"strict plain", true, []byte(content), true},
+		{"strict gzip", true, encode(t, "gzip", []byte(content)), false},
+	} {
+		var logger testLogger
+		var writeErr error
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			w.Header().Set(hdrContentEncoding, "gzip")
+			_, writeErr = w.Write(tc.body)
+		}), WithStrictContentEncoding(tc.strict), WithLogger(&logger))
+		rec := get(h, "gzip")
+
+		if (writeErr != nil) != tc.wantErr {
+			t.Errorf("%s: Write returned %v", tc.name, writeErr)
+		}
+		if tc.wantErr {
+			if len(logger.msgs) == 0 {
+				t.Errorf("%s: mismatch not logged", tc.name)
+			}
+			continue
+		}
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != "gzip" {
+			t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), tc.body) {
+			t.Errorf("%s: body changed", tc.name)
+		}
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	h := handlerWith("Hello, World!")
+	for _, tc := range []struct {
+		opts []Option
+		err  string
+	}{
+		{nil, ""},
+		{[]Option{WithLevel(flate.BestCompression), WithMinLength(0), WithMaxBuf(1024)}, ""},
+		{[]Option{WithLevel(42)}, "compression level 42 out of range [0, 11] for br"},
+		{[]Option{WithLevel(10), WithCodingLevel("br", 10)}, "compression level 10 out of range [-2, 9] for deflate"},
+		{[]Option{WithLevel(flate.HuffmanOnly)}, "compression level -2 out of range [0, 11] for br"},
+		{[]Option{WithLevel(flate.NoCompression), WithCodingLevel("br", 0)}, "compression level 0 out of range [1, 22] for zstd"},
+		{[]Option{WithLevel(flate.NoCompression), WithCodingLevel("br", 0), WithCodingLevel("zstd", 1)}, ""},
+		{[]Option{WithLevel(15), WithCodingLevel("gzip", 9), WithCodingLevel("deflate", 9), WithCodingLevel("br", 11)}, ""},
+		{[]Option{WithCodingLevel("zstd", 42)}, "compression level 42 out of range"},
+		{[]Option{WithCodingLevel("br", -1)}, "compression level -1 out of range"},
+		{[]Option{WithCodingLevel("lz4", 1)}, `compression level for unavailable coding "lz4"`},
+		{[]Option{WithMinLength(-1)}, "negative minimum length -1"},
+		{[]Option{WithMinLength(2048), WithMaxBuf(1024)}, "buffer size 1024 smaller than minimum length 2048"},
+		{[]Option{WithZstdWindowSize(1000)}, "zstd window size 1000 is not a power of 2"},
+		{[]Option{WithCompressStatusFunc(nil)}, "nil status code predicate"},
+		{[]Option{WithCompressableTypes("text/[")}, `invalid media type pattern "text/["`},
+		{[]Option{WithMinRatio(-0.5)}, "negative minimum ratio -0.5"},
+		{[]Option{WithAutoFlush(-1)}, "negative auto flush size -1"},
+		{[]Option{WithLogger(nil)}, "nil logger"},
+	} {
+		handler, err := NewWithOptions(h, tc.opts...)
+		if tc.err == "" {
+			if err != nil || handler == nil {
+				t.Errorf("got %v", err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+			t.Errorf("got %v, want %q", err, tc.err)
+		}
+		if handler != nil {
+			t.Errorf("%q: got a handler", tc.err)
+		}
+	}
+}
+
+func TestBufferThreshold(t *testing.T) {
+	raw := make([]byte, 50000)
+	rand.New(rand.NewSource(1)).Read(raw)
+	for _, tc := range []struct {
+		name      string
+		content   string
+		hasLength bool
+	}{
+		{"below floor", strings.Repeat("Hello, World! ", 50), true},
+		{"between floor and cap", strings.Repeat("Hello, World! ", 1000), true},
+		{"compresses below cap", strings.Repeat("Hello, World! ", 100000), true},
+		{"above cap", hex.EncodeToString(raw), false},
+	} {
+		h := New(handlerWith(tc.content, hdrContentType, "text/plain"),
+			WithBufferThreshold(1024), WithMaxBuf(16*1024))
+		rec := get(h, "gzip")
+		hdr := rec.Result().Header
+		if ce := hdr.Get(hdrContentEncoding); ce != "gzip" {
+			t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+		}
+		cl := hdr.Get(hdrContentLength)
+		if tc.hasLength && cl != strconv.Itoa(rec.Body.Len()) {
+			t.Errorf("%s: Content-Length %q for %d bytes", tc.name, cl, rec.Body.Len())
+		}
+		if !tc.hasLength && cl != "" {
+			t.Errorf("%s: Content-Length %q", tc.name, cl)
+		}
+		if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != tc.content {
+			t.Errorf("%s: got %d bytes", tc.name, len(got))
+		}
+	}
+}
+
+func TestDefaultCompressableTypes(t *testing.T) {
+	content := strings.Repeat("\x00asm\x01\x00\x00\x00", 100)
+	for _, tc := range []struct {
+		ctype string
+		want  string
+	}{
+		{"application/wasm", "gzip"},
+		{"font/ttf", "gzip"},
+		{"font/otf", "gzip"},
+		{"image/x-icon", "gzip"},
+		{"font/woff2", ""},
+		{"font/woff", ""},
+		{"image/png", ""},
+	} {
+		rec := get(New(handlerWith(content, hdrContentType, tc.ctype)), "gzip")
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%s: Content-Encoding %q", tc.ctype, ce)
+		}
+	}
+
+	// The defaults can be replaced
+	h := New(handlerWith(content, hdrContentType, "font/woff2"), WithCompressableTypes("font/*"))
+	if ce := get(h, "gzip").Result().Header.Get(hdrContentEncoding); ce != "gzip" {
+		t.Errorf("font/*: Content-Encoding %q", ce)
+	}
+}
+
+// lorem returns about n bytes of random words, which compress noticeably
+// better at higher levels
+func lorem(n int) string {
+	words := strings.Fields("lorem ipsum dolor sit amet consectetur adipiscing elit sed do eiusmod tempor")
+	rnd := rand.New(rand.NewSource(1))
+	var sb strings.Builder
+	for sb.Len() < n {
+		sb.WriteString(words[rnd.Intn(len(words))] + " ")
+	}
+	return sb.String()
+}
+
+// compressedSize returns the size of content compressed with encoding at level
+func compressedSize(encoding string, level int, content string) int {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w, _ = gzip.NewWriterLevel(&buf, level)
+	case "br":
+		w = brotli.NewWriterLevel(&buf, level)
+	default:
+		w, _ = flate.NewWriter(&buf, level)
+	}
+	io.WriteString(w, content)
+	w.Close()
+	return buf.Len()
+}
+
+func TestCodingLevel(t *testing.T) {
+	content := lorem(8000)
+	if compressedSize("gzip", flate.HuffmanOnly, content) == compressedSize("gzip", flate.BestCompression, content) {
+		t.Fatal("levels not distinguishable by size")
+	}
+
+	h := New(handlerWith(content, hdrContentType, "text/plain"),
+		WithLevel(flate.BestCompression), WithCodingLevel("gzip", flate.HuffmanOnly))
+	for _, tc := range []struct {
+		encoding string
+		level    int
+	}{
+		{"gzip", flate.HuffmanOnly},
+		{"deflate", flate.BestCompression},
+	} {
+		rec := get(h, tc.encoding)
+		if want := compressedSize(tc.encoding, tc.level, content); rec.Body.Len() != want {
+			t.Errorf("%s: got %d bytes, want %d for level %d", tc.encoding, rec.Body.Len(), want, tc.level)
+		}
+		if got := decode(t, tc.encoding, rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%s: got %d bytes", tc.encoding, len(got))
+		}
+	}
+}
+
+func TestNoBuffering(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, noBuffering := range []bool{false, true} {
+		var opts []Option
+		if noBuffering {
+			opts = append(opts, WithNoBuffering())
+		}
+		srv := httptest.NewServer(New(handlerWith(content, hdrContentType, "text/plain"), opts...))
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ce := res.Header.Get(hdrContentEncoding); ce != "gzip" {
+			t.Errorf("%v: Content-Encoding %q", noBuffering, ce)
+		}
+		chunked := len(res.TransferEncoding) == 1 && res.TransferEncoding[0] == "chunked"
+		if chunked != noBuffering || (res.ContentLength == -1) != noBuffering {
+			t.Errorf("%v: Content-Length %d, Transfer-Encoding %q", noBuffering, res.ContentLength, res.TransferEncoding)
+		}
+		if got := decode(t, "gzip", body); string(got) != content {
+			t.Errorf("%v: got %d bytes", noBuffering, len(got))
+		}
+	}
+}
+
+func TestNoCompressionHeadersWhenUncompressed(t *testing.T) {
+	failing := WithZstd(func(w io.Writer, level int) (WriteCloseFlusher, error) {
+		return nil, errors.New("no compressor")
+	})
+	text := strings.Repeat("Hello, World! ", 100)
+	raw := make([]byte, 4000)
+	rand.New(rand.NewSource(1)).Read(raw)
+	for _, tc := range []struct {
+		name    string
+		ctype   string
+		content string
+		accept  string
+		opts    []Option
+	}{
+		{"failing buffered", "text/plain", text, "zstd", []Option{failing}},
+		{"failing streamed", "text/plain", strings.Repeat(text, 100), "zstd", []Option{failing}},
+		{"failing no buffering", "text/plain", text, "zstd", []Option{failing, WithNoBuffering()}},
+		{"ratio", "text/plain", string(raw), "gzip", nil},
+		{"short", "text/plain", "Hello", "gzip", nil},
+		{"short no buffering", "text/plain", "Hello", "gzip", []Option{WithNoBuffering()}},
+		{"type", "image/png", text, "gzip", nil},
+		{"entropy", "application/octet-stream", string(raw), "gzip", []Option{WithEntropySniffing(true)}},
+	} {
+		opts := append([]Option{WithLogger(&testLogger{})}, tc.opts...)
+		rec := get(New(handlerWith(tc.content, hdrContentType, tc.ctype), opts...), tc.accept)
+		hdr := rec.Result().Header
+		if hdr.Get(hdrContentEncoding) != "" || hdr.Get(hdrVary) != "" {
+			t.Errorf("%s: Content-Encoding %q, Vary %q", tc.name, hdr.Get(hdrContentEncoding), hdr.Get(hdrVary))
+		}
+		if rec.Body.String() != tc.content {
+			t.Errorf("%s: got %d bytes", tc.name, rec.Body.Len())
+		}
+	}
+}
+
+func TestDeadlineGuard(t *testing.T) {
+	content := lorem(8000)
+	if compressedSize("gzip", flate.BestSpeed, content) == compressedSize("gzip", flate.BestCompression, content) {
+		t.Fatal("levels not distinguishable by size")
+	}
+
+	h := New(handlerWith(content, hdrContentType, "text/plain"),
+		WithLevel(flate.BestCompression), WithDeadlineGuard(time.Second))
+	for _, tc := range []struct {
+		name    string
+		timeout time.Duration
+		level   int
+	}{
+		{"no deadline", 0, flate.BestCompression},
+		{"far deadline", time.Hour, flate.BestCompression},
+		{"imminent deadline", 100 * time.Millisecond, flate.BestSpeed},
+	} {
+		ctx := context.Background()
+		if tc.timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+			defer cancel()
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if want := compressedSize("gzip", tc.level, content); rec.Body.Len() != want {
+			t.Errorf("%s: got %d bytes, want %d for level %d", tc.name, rec.Body.Len(), want, tc.level)
+		}
+		if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%s: got %d bytes", tc.name, len(got))
+		}
+	}
+}
+
+func TestDefaultCodingLevels(t *testing.T) {
+	content := lorem(8000)
+	for _, tc := range []struct {
+		name  string
+		opts  []Option
+		level int
+	}{
+		{"default", nil, 4},
+		{"general level", []Option{WithLevel(flate.BestCompression)}, flate.BestCompression},
+		{"coding level", []Option{WithLevel(flate.BestSpeed), WithCodingLevel("br", 11)}, 11},
+	} {
+		rec := get(New(handlerWith(content, hdrContentType, "text/plain"), tc.opts...), "br")
+		if want := compressedSize("br", tc.level, content); rec.Body.Len() != want {
+			t.Errorf("%s: got %d bytes, want %d for level %d", tc.name, rec.Body.Len(), want, tc.level)
+		}
+		if got := decode(t, "br", rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%s: got %d bytes", tc.name, len(got))
+		}
+	}
+}
+
+func TestShouldCompress(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	var codes []int
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrContentType, "text/plain")
+		if r.URL.Path == "/form" {
+			w.Header().Set("X-CSRF-Token", "secret")
+		}
+		io.WriteString(w, content)
+	}), WithShouldCompress(func(code int, hdr http.Header, r *http.Request) bool {
+		codes = append(codes, code)
+		return hdr.Get("X-CSRF-Token") == "" && r.URL.Query().Get("raw") == ""
+	}))
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"/", "gzip"},
+		{"/form", ""},
+		{"/?raw=1", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%s: Content-Encoding %q", tc.path, ce)
+		}
+		if got := decode(t, tc.want, rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%s: got %d bytes", tc.path, len(got))
+		}
+	}
+	if len(codes) != 3 || codes[0] != http.StatusOK {
+		t.Errorf("called with %v", codes)
+	}
+}
+
+func TestSkipSensitive(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, tc := range []struct {
+		name          string
+		enable        bool
+		cookie        bool
+		authorization bool
+		want          string
+	}{
+		{"plain", true, false, false, "gzip"},
+		{"set-cookie", true, true, false, ""},
+		{"authorization", true, false, true, ""},
+		{"disabled", false, true, true, "gzip"},
+	} {
+		kv := []string{hdrContentType, "text/plain"}
+		if tc.cookie {
+			kv = append(kv, hdrSetCookie, "session=secret")
+		}
+		h := New(handlerWith(content, kv...), WithSkipSensitive(tc.enable), WithDebugHeaders())
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		if tc.authorization {
+			req.Header.Set(hdrAuthorization, "Bearer secret")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		hdr := rec.Result().Header
+
+		if ce := hdr.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+		}
+		wantSkipped := ""
+		if tc.want == "" {
+			wantSkipped = SkipSensitive
+		}
+		if skipped := hdr.Get(hdrXCompressSkipped); skipped != wantSkipped {
+			t.Errorf("%s: skipped %q, want %q", tc.name, skipped, wantSkipped)
+		}
+	}
+}
+
+func TestRandomPadding(t *testing.T) {
+	const max = 100
+	content := strings.Repeat("Hello, World! ", 100)
+	h := New(handlerWith(content, hdrContentType, "text/plain"), WithRandomPadding(max))
+	lengths := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		rec := get(h, "gzip")
+		zr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		extra := zr.Header.Extra
+		if len(extra) < 4 || len(extra) > 4+max || string(extra[:2]) != "Pd" {
+			t.Fatalf("extra field %q", extra)
+		}
+		lengths[len(extra)] = true
+		if got, err := io.ReadAll(zr); err != nil || string(got) != content {
+			t.Fatalf("got %d bytes, %v", len(got), err)
+		}
+	}
+	if len(lengths) < 2 {
+		t.Errorf("padding lengths %v", lengths)
+	}
+}
+
+func TestPathRules(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	h := New(handlerWith(content, hdrContentType, "text/plain"),
+		WithIncludePrefix("/api/"), WithIncludePaths("/index.html"), WithIncludeRegexp(regexp.MustCompile(`\.css$`)),
+		WithExcludePaths("/api/metrics"), WithExcludePrefix("/api/raw/"), WithExcludeRegexp(regexp.MustCompile(`\.min\.css$`)))
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"/api/users", "gzip"},
+		{"/index.html", "gzip"},
+		{"/style.css", "gzip"},
+		{"/about.html", ""},
+		{"/api/metrics", ""},
+		{"/api/raw/dump", ""},
+		{"/style.min.css", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%s: Content-Encoding %q", tc.path, ce)
+		}
+		if got := decode(t, tc.want, rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%s: got %d bytes", tc.path, len(got))
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	var got []Stats
+	h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrContentType, "text/plain; charset=utf-8")
+		if r.URL.Path == "/short" {
+			io.WriteString(w, "Hello")
+			return
+		}
+		io.WriteString(w, content)
+	}), WithStats(func(s Stats) { got = append(got, s) }))
+	for _, tc := range []struct {
+		path, accept string
+	}{
+		{"/", "gzip"},
+		{"/short", "gzip"},
+		{"/", "compress"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set(hdrAcceptEncoding, tc.accept)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// The client without a common coding is not reported
+	if len(got) != 2 {
+		t.Fatalf("%d stats", len(got))
+	}
+	s := got[0]
+	if s.Encoding != "gzip" || s.SkipReason != "" || s.ContentType != "text/plain" || !s.Buffered ||
+		s.UncompressedSize != int64(len(content)) || s.CompressedSize <= 0 || s.CompressedSize >= s.UncompressedSize ||
+		s.Request == nil || s.Request.URL.Path != "/" {
+		t.Errorf("compressed: %+v", s)
+	}
+	s = got[1]
+	if s.Encoding != "" || s.SkipReason != SkipLength || s.UncompressedSize != 5 || s.CompressedSize != 5 {
+		t.Errorf("short: %+v", s)
+	}
+}
+
+func TestDebugHeaders(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, tc := range []struct {
+		name    string
+		content string
+		opts    []Option
+		encoder string
+		skipped string
+	}{
+		{"default level", content, nil, "gzip; level=default", ""},
+		{"level", content, []Option{WithLevel(5)}, "gzip; level=5", ""},
+		{"short", "Hello", nil, "", SkipLength},
+	} {
+		h := New(handlerWith(tc.content, hdrContentType, "text/plain"), append(tc.opts, WithDebugHeaders())...)
+		rec := get(h, "gzip")
+		hdr := rec.Result().Header
+
+		if enc := hdr.Get(hdrXCompressEncoder); enc != tc.encoder {
+			t.Errorf("%s: encoder %q, want %q", tc.name, enc, tc.encoder)
+		}
+		if skipped := hdr.Get(hdrXCompressSkipped); skipped != tc.skipped {
+			t.Errorf("%s: skipped %q, want %q", tc.name, skipped, tc.skipped)
+		}
+		wantLength, wantRatio := "", ""
+		if tc.encoder != "" {
+			wantLength = strconv.Itoa(len(tc.content))
+			wantRatio = strconv.FormatFloat(float64(rec.Body.Len())/float64(len(tc.content)), 'f', 3, 64)
+		}
+		if l := hdr.Get(hdrXCompressOriginalLength); l != wantLength {
+			t.Errorf("%s: original length %q, want %q", tc.name, l, wantLength)
+		}
+		if r := hdr.Get(hdrXCompressRatio); r != wantRatio {
+			t.Errorf("%s: ratio %q, want %q", tc.name, r, wantRatio)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	small := strings.Repeat("Hello, World! ", 100)
+	large := strings.Repeat("Hello, World! ", 100000)
+	entry := regexp.MustCompile(`^compress;dur=\d+\.\d{3};desc="gzip"$`)
+	for _, tc := range []struct {
+		name    string
+		content string
+		header  int // entries in the header
+		trailer int // entries in the trailer
+	}{
+		{"buffered", small, 2, 0},
+		{"streamed", large, 1, 1},
+		{"short", "Hello", 1, 0},
+	} {
+		h := New(handlerWith(tc.content, hdrContentType, "text/plain", hdrServerTiming, "db;dur=5"), WithServerTiming())
+		res := get(h, "gzip").Result()
+		io.ReadAll(res.Body)
+
+		header, trailer := res.Header.Values(hdrServerTiming), res.Trailer.Values(hdrServerTiming)
+		if len(header) != tc.header || len(trailer) != tc.trailer || header[0] != "db;dur=5" {
+			t.Errorf("%s: Server-Timing %q, trailer %q", tc.name, header, trailer)
+			continue
+		}
+		for _, v := range append(header[1:], trailer...) {
+			if !entry.MatchString(v) {
+				t.Errorf("%s: Server-Timing entry %q", tc.name, v)
+			}
+		}
+	}
+}
+
+// blockingHandler writes content and then blocks requests for /block, after
+// the header is sent, until release is closed. started receives a value once
+// such a request is blocked.
+func blockingHandler(content string, started chan<- struct{}, release <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(hdrContentType, "text/plain")
+		io.WriteString(w, content)
+		if r.URL.Path == "/block" {
+			w.(http.Flusher).Flush()
+			started <- struct{}{}
+			<-release
+		}
+	})
+}
+
+// block starts n requests for /block in the background and waits until they
+// are blocked. The returned function releases them and waits for them to end.
+func block(h http.Handler, n int, started <-chan struct{}, release chan struct{}) func() {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodGet, "/block", nil)
+			req.Header.Set(hdrAcceptEncoding, "gzip")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+		}()
+		<-started
+	}
+	return func() {
+		close(release)
+		wg.Wait()
+	}
+}
+
+func TestAdaptiveLevel(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, tc := range []struct {
+		name    string
+		blocked int
+		encoder string
+		skipped string
+	}{
+		{"idle", 0, "gzip; level=default", ""},
+		{"busy", 1, "gzip; level=1", ""},
+		{"overloaded", 2, "", SkipOverloaded},
+	} {
+		started, release := make(chan struct{}), make(chan struct{})
+		h := New(blockingHandler(content, started, release), WithAdaptiveLevel(1, 2), WithDebugHeaders())
+		done := block(h, tc.blocked, started, release)
+		hdr := get(h, "gzip").Result().Header
+		done()
+
+		if enc := hdr.Get(hdrXCompressEncoder); enc != tc.encoder {
+			t.Errorf("%s: encoder %q, want %q", tc.name, enc, tc.encoder)
+		}
+		if skipped := hdr.Get(hdrXCompressSkipped); skipped != tc.skipped {
+			t.Errorf("%s: skipped %q, want %q", tc.name, skipped, tc.skipped)
+		}
+	}
+}
+
+func TestLevelBySize(t *testing.T) {
+	small := strings.Repeat("Hello, World! ", 100)
+	large := strings.Repeat("Hello, World! ", 1000)
+	for _, tc := range []struct {
+		name    string
+		content string
+		kv      []string
+		opts    []Option
+		encoder string
+	}{
+		{"small", small, nil, nil, "gzip; level=2"},
+		{"large", large, nil, nil, "gzip; level=8"},
+		{"streamed", small, nil, []Option{WithNoBuffering()}, "gzip; level=8"},
+		{"streamed with length", small, []string{hdrContentLength, strconv.Itoa(len(small))}, []Option{WithNoBuffering()}, "gzip; level=2"},
+		{"coding level", small, nil, []Option{WithCodingLevel("gzip", 5)}, "gzip; level=5"},
+	} {
+		kv := append([]string{hdrContentType, "text/plain"}, tc.kv...)
+		opts := append([]Option{WithLevelBySize(len(small)+1, 2, 8), WithDebugHeaders()}, tc.opts...)
+		hdr := get(New(handlerWith(tc.content, kv...), opts...), "gzip").Result().Header
+		if enc := hdr.Get(hdrXCompressEncoder); enc != tc.encoder {
+			t.Errorf("%s: encoder %q, want %q", tc.name, enc, tc.encoder)
+		}
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, tc := range []struct {
+		name    string
+		wait    time.Duration
+		blocked int
+		release bool // release the blocked requests while waiting
+		want    string
+	}{
+		{"free", 0, 0, false, "gzip"},
+		{"full", 0, 1, false, ""},
+		{"full after waiting", 10 * time.Millisecond, 1, false, ""},
+		{"freed while waiting", time.Minute, 1, true, "gzip"},
+	} {
+		started, release := make(chan struct{}), make(chan struct{})
+		h := New(blockingHandler(content, started, release), WithMaxConcurrent(1, tc.wait), WithDebugHeaders())
+		done := block(h, tc.blocked, started, release)
+		if tc.release {
+			time.AfterFunc(10*time.Millisecond, done)
+		}
+		hdr := get(h, "gzip").Result().Header
+		if !tc.release {
+			done()
+		}
+
+		if ce := hdr.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+		}
+		if skipped := hdr.Get(hdrXCompressSkipped); tc.want == "" && skipped != SkipOverloaded {
+			t.Errorf("%s: skipped %q", tc.name, skipped)
+		}
+	}
+}
+
+func TestHTTP10(t *testing.T) {
+	large := strings.Repeat("Hello, World! ", 100000)
+	for _, tc := range []struct {
+		name   string
+		mode   HTTP10Mode
+		proto  string
+		want   string
+		length bool
+	}{
+		{"stream", HTTP10Stream, "HTTP/1.0", "gzip", false},
+		{"buffer", HTTP10Buffer, "HTTP/1.0", "gzip", true},
+		{"buffer HTTP/1.1", HTTP10Buffer, "HTTP/1.1", "gzip", false},
+		{"skip", HTTP10Skip, "HTTP/1.0", "", true},
+		{"skip HTTP/1.1", HTTP10Skip, "HTTP/1.1", "gzip", false},
+	} {
+		h := New(handlerWith(large, hdrContentType, "text/plain", hdrContentLength, strconv.Itoa(len(large))),
+			WithHTTP10(tc.mode))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Proto = tc.proto
+		req.ProtoMajor, req.ProtoMinor, _ = http.ParseHTTPVersion(tc.proto)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		hdr := rec.Result().Header
+
+		if ce := hdr.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+		}
+		if cl := hdr.Get(hdrContentLength); (cl != "") != tc.length || tc.length && cl != strconv.Itoa(rec.Body.Len()) {
+			t.Errorf("%s: Content-Length %q, body %d bytes", tc.name, cl, rec.Body.Len())
+		}
+		if got := decode(t, tc.want, rec.Body.Bytes()); string(got) != large {
+			t.Errorf("%s: got %d bytes", tc.name, len(got))
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"compressed", content, "gzip"},
+		{"short", "Hello", ""},
+	} {
+		h := New(handlerWith(tc.content, hdrContentType, "text/plain", hdrContentLength, strconv.Itoa(len(tc.content))))
+		req := httptest.NewRequest(http.MethodHead, "/", nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		head := rec.Result().Header
+		getHdr := get(h, "gzip").Result().Header
+
+		// Uncompressed bodies are dropped by the server, not by New
+		if tc.want != "" && rec.Body.Len() != 0 {
+			t.Errorf("%s: %d bytes of body", tc.name, rec.Body.Len())
+		}
+		if ce := head.Get(hdrContentEncoding); ce != tc.want {
+			t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+		}
+		for _, key := range []string{hdrContentEncoding, hdrVary, hdrContentType} {
+			if head.Get(key) != getHdr.Get(key) {
+				t.Errorf("%s: %s %q, GET has %q", tc.name, key, head.Get(key), getHdr.Get(key))
+			}
+		}
+		// The compressed length is unknown without compressing
+		wantCL := strconv.Itoa(len(tc.content))
+		if tc.want != "" {
+			wantCL = ""
+		}
+		if cl := head.Get(hdrContentLength); cl != wantCL {
+			t.Errorf("%s: Content-Length %q, want %q", tc.name, cl, wantCL)
+		}
+	}
+}
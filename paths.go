@@ -0,0 +1,61 @@
+package compress
+
+import (
+	"regexp"
+	"strings"
+)
+
+// pathMatcher matches request paths exactly, by prefix or by regexp
+type pathMatcher struct {
+	exact    map[string]bool
+	prefixes []string
+	regexps  []*regexp.Regexp
+}
+
+func (pm *pathMatcher) empty() bool {
+	return len(pm.exact) == 0 && len(pm.prefixes) == 0 && len(pm.regexps) == 0
+}
+
+func (pm *pathMatcher) addExact(paths []string) {
+	if pm.exact == nil {
+		pm.exact = make(map[string]bool)
+	}
+	for _, p := range paths {
+		pm.exact[p] = true
+	}
+}
+
+func (pm *pathMatcher) match(path string) bool {
+	if pm.exact[path] {
+		return true
+	}
+	for _, prefix := range pm.prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	for _, re := range pm.regexps {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasNilRegexp(regexps []*regexp.Regexp) bool {
+	for _, re := range regexps {
+		if re == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// pathAllowed reports whether responses to requests for path may be
+// compressed. Excludes take precedence over includes.
+func (cfg *config) pathAllowed(path string) bool {
+	if cfg.excludePaths.match(path) {
+		return false
+	}
+	return cfg.includePaths.empty() || cfg.includePaths.match(path)
+}
@@ -0,0 +1,173 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"runtime"
+
+	"github.com/pkg/errors"
+)
+
+// parallelBlockSize is the amount of content each goroutine of
+// parallelGzipWriter compresses
+const parallelBlockSize = 1 << 20
+
+// flateWindow is the distance deflate can refer back to. The end of the
+// previous block is used as preset dictionary, so splitting the content
+// costs next to nothing in compression ratio.
+const flateWindow = 32 << 10
+
+// parallelBlock is a compressed block ending with a sync flush
+type parallelBlock struct {
+	out []byte
+	err error
+}
+
+/*
+parallelGzipWriter is a gzip compressor for large responses, that splits the
+content into blocks and compresses them in parallel. The blocks are written in
+order as deflate stream with a single gzip header and trailer, so the result
+is a regular gzip member.
+*/
+type parallelGzipWriter struct {
+	w      io.Writer
+	level  int
+	header []byte // gzip header, until it is written
+
+	block []byte               // content not yet handed to a goroutine
+	dict  []byte               // end of the previous block
+	queue []chan parallelBlock // blocks being compressed, in order
+
+	crc  uint32
+	size uint32 // uncompressed size modulo 2^32, as in the trailer
+
+	err    error
+	closed bool
+}
+
+func newParallelGzipWriter(w io.Writer, level int, osByte byte) *parallelGzipWriter {
+	return &parallelGzipWriter{
+		w:      w,
+		level:  level,
+		header: []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, osByte},
+	}
+}
+
+func (pw *parallelGzipWriter) Write(p []byte) (int, error) {
+	if pw.err != nil {
+		return 0, pw.err
+	}
+	if pw.closed {
+		return 0, errors.New("Write after Close in parallel gzip writer")
+	}
+	pw.crc = crc32.Update(pw.crc, crc32.IEEETable, p)
+	pw.size += uint32(len(p))
+
+	for n := 0; n < len(p); {
+		if pw.block == nil {
+			pw.block = make([]byte, 0, parallelBlockSize)
+		}
+		k := copy(pw.block[len(pw.block):cap(pw.block)], p[n:])
+		pw.block = pw.block[:len(pw.block)+k]
+		n += k
+		if len(pw.block) == cap(pw.block) {
+			if pw.err = pw.startBlock(); pw.err != nil {
+				return n, pw.err
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// startBlock compresses the current block in the background. Once all CPUs
+// are busy, it waits for the oldest block and writes it.
+func (pw *parallelGzipWriter) startBlock() error {
+	block, dict, level := pw.block, pw.dict, pw.level
+	pw.block = nil
+
+	next := append(dict[:len(dict):len(dict)], block...)
+	if len(next) > flateWindow {
+		next = next[len(next)-flateWindow:]
+	}
+	pw.dict = append([]byte(nil), next...)
+
+	ch := make(chan parallelBlock, 1)
+	go func() {
+		var out bytes.Buffer
+		fw, err := flate.NewWriterDict(&out, level, dict)
+		if err == nil {
+			_, err = fw.Write(block)
+		}
+		if err == nil {
+			// Ends on a byte boundary without ending the stream
+			err = fw.Flush()
+		}
+		ch <- parallelBlock{out.Bytes(), errors.Wrap(err, "Compressing block failed")}
+	}()
+	pw.queue = append(pw.queue, ch)
+	return pw.drain(runtime.GOMAXPROCS(0) - 1)
+}
+
+// drain writes the finished blocks in order, until at most keep are left in
+// the queue
+func (pw *parallelGzipWriter) drain(keep int) error {
+	for len(pw.queue) > keep {
+		b := <-pw.queue[0]
+		pw.queue = pw.queue[1:]
+		if b.err != nil {
+			return b.err
+		}
+		if err := pw.write(b.out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes p, preceded by the header if it wasn't written yet
+func (pw *parallelGzipWriter) write(p []byte) error {
+	if pw.header != nil {
+		if _, err := pw.w.Write(pw.header); err != nil {
+			return err
+		}
+		pw.header = nil
+	}
+	_, err := pw.w.Write(p)
+	return err
+}
+
+// Flush compresses and writes everything written so far
+func (pw *parallelGzipWriter) Flush() error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if len(pw.block) > 0 {
+		if pw.err = pw.startBlock(); pw.err != nil {
+			return pw.err
+		}
+	}
+	pw.err = pw.drain(0)
+	return pw.err
+}
+
+// Close flushes the content and finishes the gzip stream
+func (pw *parallelGzipWriter) Close() error {
+	if pw.closed {
+		return pw.err
+	}
+	if pw.Flush() != nil {
+		pw.closed = true
+		return pw.err
+	}
+	pw.closed = true
+
+	// An empty final stored block ends the deflate stream
+	end := []byte{1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(end[5:], pw.crc)
+	binary.LittleEndian.PutUint32(end[9:], pw.size)
+	pw.err = pw.write(end)
+	return pw.err
+}
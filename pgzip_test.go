@@ -0,0 +1,85 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestParallelGzipWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		size  int
+		chunk int // size of the writes, 0 writes all at once
+	}{
+		{"empty", 0, 0},
+		{"below one block", 1000, 0},
+		{"one block", parallelBlockSize, 0},
+		{"several blocks", 3*parallelBlockSize + 123, 0},
+		{"writes crossing blocks", 3*parallelBlockSize + 123, 300000},
+	} {
+		content := []byte(lorem(tc.size))[:tc.size]
+		var buf bytes.Buffer
+		pw := newParallelGzipWriter(&buf, flate.DefaultCompression, 255)
+		chunk := tc.chunk
+		if chunk == 0 {
+			chunk = len(content) + 1
+		}
+		for p := content; len(p) > 0; {
+			n := min(chunk, len(p))
+			if _, err := pw.Write(p[:n]); err != nil {
+				t.Fatalf("%s: %v", tc.name, err)
+			}
+			p = p[n:]
+		}
+		if err := pw.Close(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if got := decode(t, "gzip", buf.Bytes()); !bytes.Equal(got, content) {
+			t.Errorf("%s: got %d bytes, want %d", tc.name, len(got), len(content))
+		}
+		if _, err := pw.Write([]byte("x")); err == nil {
+			t.Errorf("%s: Write after Close succeeded", tc.name)
+		}
+	}
+}
+
+// isParallelGzip reports whether p ends like the output of
+// parallelGzipWriter, with an empty final stored block before the trailer
+func isParallelGzip(p []byte) bool {
+	return len(p) >= 13 && bytes.Equal(p[len(p)-13:len(p)-8], []byte{1, 0, 0, 0xff, 0xff})
+}
+
+func TestParallelGzipThreshold(t *testing.T) {
+	const threshold = 100000
+	content := lorem(threshold)[:threshold]
+	for _, tc := range []struct {
+		name     string
+		length   int
+		parallel bool
+	}{
+		{"below", threshold - 1, false},
+		{"at", threshold, true},
+	} {
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			w.Header().Set(hdrContentLength, strconv.Itoa(tc.length))
+			io.WriteString(w, content[:tc.length])
+		}), WithParallelGzip(threshold))
+		rec := get(h, "gzip")
+
+		if ce := rec.Result().Header.Get(hdrContentEncoding); ce != "gzip" {
+			t.Fatalf("%s: Content-Encoding %q", tc.name, ce)
+		}
+		if got := isParallelGzip(rec.Body.Bytes()); got != tc.parallel {
+			t.Errorf("%s: parallel %v, want %v", tc.name, got, tc.parallel)
+		}
+		if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != content[:tc.length] {
+			t.Errorf("%s: got %d bytes, want %d", tc.name, len(got), tc.length)
+		}
+	}
+}
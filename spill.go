@@ -0,0 +1,77 @@
+package compress
+
+import (
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// spillToFile reports whether the next n bytes of compressed content go to a
+// temporary file, see WithSpillToDisk. The file is created on first use and
+// takes over the content of the buffer.
+func (crw *compressResponseWriter) spillToFile(n int) bool {
+	if crw.cfg.spillLimit <= 0 || int64(crw.buf.Len())+crw.fileSize+int64(n) > crw.cfg.spillLimit {
+		return false
+	}
+	if crw.file != nil {
+		return true
+	}
+
+	f, err := os.CreateTemp(crw.cfg.spillDir, "compress-*")
+	if err != nil {
+		crw.cfg.logger.Printf("%v", errors.Wrap(err, "Creating spill file failed"))
+		return false
+	}
+	crw.file = f
+	if _, err = f.Write(crw.buf.Bytes()); err != nil {
+		crw.cfg.logger.Printf("%v", errors.Wrap(err, "Writing spill file failed"))
+		crw.removeFile()
+		return false
+	}
+	crw.fileSize = int64(crw.buf.Len())
+	crw.buf.Reset()
+	return true
+}
+
+// writeFile appends p to the temporary file
+func (crw *compressResponseWriter) writeFile(p []byte) (int, error) {
+	n, err := crw.file.Write(p)
+	crw.fileSize += int64(n)
+	return n, errors.Wrap(err, "Writing spill file failed")
+}
+
+// sendFile writes the content of the temporary file and removes it
+func (crw *compressResponseWriter) sendFile() error {
+	defer crw.removeFile()
+	if _, err := crw.file.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "Rewinding spill file failed")
+	}
+	_, err := io.Copy(sentWriter{crw}, crw.file)
+	return err
+}
+
+// writeSpilled writes the header with a proper Content-Length and the
+// complete content of the temporary file, like writeBuffer
+func (crw *compressResponseWriter) writeSpilled() error {
+	if !hasTrailers(crw.Header()) {
+		crw.Header().Set(hdrContentLength, strconv.FormatInt(crw.fileSize, 10))
+	}
+	crw.buffered = true
+	crw.setDebugHeaders(int(crw.fileSize))
+	crw.addServerTiming(hdrServerTiming)
+	crw.ResponseWriter.WriteHeader(crw.code)
+	return crw.sendFile()
+}
+
+// removeFile closes and deletes the temporary file, if there is one
+func (crw *compressResponseWriter) removeFile() {
+	if crw.file == nil {
+		return
+	}
+	crw.file.Close()
+	os.Remove(crw.file.Name())
+	crw.file = nil
+	crw.fileSize = 0
+}
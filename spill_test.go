@@ -0,0 +1,76 @@
+package compress
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestSpillToDisk(t *testing.T) {
+	content := lorem(200000)
+	for _, tc := range []struct {
+		name    string
+		limit   int64
+		panics  bool
+		broken  bool
+		chunked bool
+	}{
+		{"spilled", 1 << 20, false, false, false},
+		{"panic", 1 << 20, true, false, false},
+		{"write error", 1 << 20, false, true, false},
+		{"over limit", 4096, false, false, true},
+	} {
+		dir := t.TempDir()
+		var files int
+		h := New(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(hdrContentType, "text/plain")
+			io.WriteString(w, content)
+			entries, _ := os.ReadDir(dir)
+			files = len(entries)
+			if tc.panics {
+				panic("handler failed")
+			}
+		}), WithMinLength(0), WithMaxBuf(1024), WithSpillToDisk(dir, tc.limit),
+			WithErrorHandler(func(r *http.Request, err error) {}))
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(hdrAcceptEncoding, "gzip")
+		rec := httptest.NewRecorder()
+		var w http.ResponseWriter = rec
+		if tc.broken {
+			w = brokenWriter{rec}
+		}
+		func() {
+			defer func() {
+				if p := recover(); (p != nil) != tc.panics {
+					t.Errorf("%s: recovered %v", tc.name, p)
+				}
+			}()
+			h.ServeHTTP(w, req)
+		}()
+
+		if !tc.chunked && files != 1 {
+			t.Errorf("%s: %d temporary files during the response", tc.name, files)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("%s: %d temporary files left", tc.name, len(entries))
+		}
+		if tc.panics || tc.broken {
+			continue
+		}
+
+		cl := rec.Result().Header.Get(hdrContentLength)
+		if tc.chunked && cl != "" {
+			t.Errorf("%s: Content-Length %q", tc.name, cl)
+		}
+		if !tc.chunked && cl != strconv.Itoa(rec.Body.Len()) {
+			t.Errorf("%s: Content-Length %q, body %d bytes", tc.name, cl, rec.Body.Len())
+		}
+		if got := decode(t, "gzip", rec.Body.Bytes()); string(got) != content {
+			t.Errorf("%s: got %d bytes, want %d", tc.name, len(got), len(content))
+		}
+	}
+}
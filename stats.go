@@ -0,0 +1,234 @@
+package compress
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// encodingStats counts the negotiated encodings, mapping names to *uint64
+var encodingStats sync.Map
+
+func countEncoding(name string) {
+	cnt, ok := encodingStats.Load(name)
+	if !ok {
+		cnt, _ = encodingStats.LoadOrStore(name, new(uint64))
+	}
+	atomic.AddUint64(cnt.(*uint64), 1)
+}
+
+// EncodingStats returns how often each encoding was negotiated with clients
+// since the start of the program. Requests without a common encoding are
+// counted as "none".
+func EncodingStats() map[string]uint64 {
+	stats := make(map[string]uint64)
+	encodingStats.Range(func(name, cnt interface{}) bool {
+		stats[name.(string)] = atomic.LoadUint64(cnt.(*uint64))
+		return true
+	})
+	return stats
+}
+
+// Reasons for responses passed through uncompressed, as reported by Metrics
+const (
+	SkipDisabled    = "disabled"     // DisableCompression was called
+	SkipPath        = "path"         // excluded by the path rules
+	SkipNoTransform = "no-transform" // Cache-Control: no-transform in the request or response
+	SkipUpgrade     = "upgrade"      // protocol upgrade
+	SkipHTTP10      = "http/1.0"     // see HTTP10Skip
+	SkipPrefer      = "prefer"       // the client sent Prefer: no-compression
+	SkipNotAccepted = "not-accepted" // no common coding with the client
+	SkipStatus      = "status"       // the status code has no or no compressable body
+	SkipRange       = "range"        // partial content
+	SkipLength      = "length"       // the content is too short
+	SkipEncoded     = "encoded"      // the handler set a Content-Encoding
+	SkipType        = "type"         // the Content-Type is not compressable
+	SkipHandler     = "handler"      // SkipCompression was called
+	SkipSensitive   = "sensitive"    // see WithSkipSensitive
+	SkipPredicate   = "predicate"    // see WithShouldCompress
+	SkipOverloaded  = "overloaded"   // see WithAdaptiveLevel and WithMaxConcurrent
+	SkipEntropy     = "entropy"      // the content looks compressed already
+	SkipRatio       = "ratio"        // compression didn't pay off
+	SkipHijacked    = "hijacked"     // the handler took over the connection
+	SkipError       = "error"        // the compressor failed
+)
+
+// skipStats counts the uncompressed responses by reason, mapping reasons to
+// *uint64
+var skipStats sync.Map
+
+func countSkip(reason string) {
+	cnt, ok := skipStats.Load(reason)
+	if !ok {
+		cnt, _ = skipStats.LoadOrStore(reason, new(uint64))
+	}
+	atomic.AddUint64(cnt.(*uint64), 1)
+}
+
+// MetricsKey identifies compressed responses by coding and media type
+type MetricsKey struct {
+	Encoding    string
+	ContentType string
+}
+
+// String returns e.g. "gzip text/html", as used by PublishExpvar
+func (k MetricsKey) String() string {
+	return k.Encoding + " " + k.ContentType
+}
+
+// CompressionMetrics sums up compressed responses
+type CompressionMetrics struct {
+	Responses    uint64
+	BytesIn      uint64        // uncompressed bytes written by the handlers
+	BytesOut     uint64        // compressed bytes sent to the clients
+	CompressTime time.Duration // wall time spent compressing
+}
+
+// Ratio returns BytesOut/BytesIn, i.e. the achieved compression ratio
+func (m CompressionMetrics) Ratio() float64 {
+	if m.BytesIn == 0 {
+		return 0
+	}
+	return float64(m.BytesOut) / float64(m.BytesIn)
+}
+
+// compressionCounters is the atomically updated version of CompressionMetrics
+type compressionCounters struct {
+	responses, bytesIn, bytesOut, nanos uint64
+}
+
+// compressionStats maps MetricsKeys to *compressionCounters
+var compressionStats sync.Map
+
+func countCompression(key MetricsKey, in, out int64, d time.Duration) {
+	cnt, ok := compressionStats.Load(key)
+	if !ok {
+		cnt, _ = compressionStats.LoadOrStore(key, new(compressionCounters))
+	}
+	c := cnt.(*compressionCounters)
+	atomic.AddUint64(&c.responses, 1)
+	atomic.AddUint64(&c.bytesIn, uint64(in))
+	atomic.AddUint64(&c.bytesOut, uint64(out))
+	atomic.AddUint64(&c.nanos, uint64(d))
+}
+
+// recordMetrics counts a finished response
+func recordMetrics(s Stats) {
+	if s.Encoding == "" {
+		countSkip(s.SkipReason)
+		return
+	}
+	key := MetricsKey{s.Encoding, s.ContentType}
+	countCompression(key, s.UncompressedSize, s.CompressedSize, s.CompressTime)
+}
+
+// Metrics is a snapshot of the compression activity of all middlewares since
+// the start of the program
+type Metrics struct {
+	// Skipped counts the responses sent uncompressed by reason, see the
+	// Skip constants
+	Skipped map[string]uint64
+	// Compressed sums up the compressed responses
+	Compressed map[MetricsKey]CompressionMetrics
+}
+
+// GetMetrics returns the current Metrics, e.g. to export them to Prometheus
+// or to tune WithMinLength and the compression level from real data.
+func GetMetrics() Metrics {
+	m := Metrics{
+		Skipped:    make(map[string]uint64),
+		Compressed: make(map[MetricsKey]CompressionMetrics),
+	}
+	skipStats.Range(func(reason, cnt interface{}) bool {
+		m.Skipped[reason.(string)] = atomic.LoadUint64(cnt.(*uint64))
+		return true
+	})
+	compressionStats.Range(func(key, cnt interface{}) bool {
+		c := cnt.(*compressionCounters)
+		m.Compressed[key.(MetricsKey)] = CompressionMetrics{
+			Responses:    atomic.LoadUint64(&c.responses),
+			BytesIn:      atomic.LoadUint64(&c.bytesIn),
+			BytesOut:     atomic.LoadUint64(&c.bytesOut),
+			CompressTime: time.Duration(atomic.LoadUint64(&c.nanos)),
+		}
+		return true
+	})
+	return m
+}
+
+/*
+PublishExpvar publishes the Metrics and EncodingStats under name with the
+expvar package, so they show up at /debug/vars. Like expvar.Publish, it panics
+if name is already in use.
+*/
+func PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		m := GetMetrics()
+		compressed := make(map[string]interface{}, len(m.Compressed))
+		for key, c := range m.Compressed {
+			compressed[key.String()] = map[string]interface{}{
+				"responses":   c.Responses,
+				"bytes_in":    c.BytesIn,
+				"bytes_out":   c.BytesOut,
+				"ratio":       c.Ratio(),
+				"compress_ns": int64(c.CompressTime),
+			}
+		}
+		return map[string]interface{}{
+			"encodings":  EncodingStats(),
+			"skipped":    m.Skipped,
+			"compressed": compressed,
+		}
+	}))
+}
+
+// Stats describes a single response, see WithStats
+type Stats struct {
+	Request *http.Request
+
+	// Encoding is the coding of the response or "" if it was sent
+	// uncompressed. SkipReason tells why in that case.
+	Encoding   string
+	SkipReason string
+	// ContentType is the media type of the response without parameters
+	ContentType string
+
+	UncompressedSize int64 // bytes written by the handler
+	CompressedSize   int64 // bytes sent, equals UncompressedSize if not compressed
+
+	Duration     time.Duration // time from calling the handler to the end of the response
+	CompressTime time.Duration // wall time spent compressing
+	// Buffered is set if the response was held back and sent with a
+	// Content-Length. Otherwise it was streamed.
+	Buffered bool
+}
+
+// stats collects the Stats of a finished response
+func (crw *compressResponseWriter) stats(start time.Time) Stats {
+	s := Stats{
+		Request:          crw.r,
+		ContentType:      getMediaType(crw.Header()),
+		UncompressedSize: crw.written,
+		CompressedSize:   crw.written,
+		Duration:         time.Since(start),
+		CompressTime:     crw.compressTime,
+		Buffered:         crw.buffered,
+	}
+	switch {
+	case crw.compressed:
+		s.Encoding = crw.c.String()
+		s.CompressedSize = crw.sent
+	case crw.hijacked:
+		s.SkipReason = SkipHijacked
+	case crw.skipped != "":
+		s.SkipReason = crw.skipped
+	case crw.err != nil:
+		s.SkipReason = SkipError
+	default:
+		// The handler didn't write anything
+		s.SkipReason = SkipLength
+	}
+	return s
+}
@@ -0,0 +1,85 @@
+package compress
+
+import (
+	"encoding/json"
+	"expvar"
+	"strings"
+	"testing"
+)
+
+func TestEncodingStats(t *testing.T) {
+	h := New(handlerWith("Hello, World!"))
+	accepts := map[string]string{
+		"gzip":              "gzip",
+		"deflate":           "deflate",
+		"br":                "br",
+		"zstd":              "zstd",
+		"":                  "none",
+		"compress":          "none",
+		"gzip;q=0.5, br":    "br",
+		"deflate, gzip;q=0": "deflate",
+	}
+	want := make(map[string]uint64)
+	before := EncodingStats()
+	for accept, encoding := range accepts {
+		get(h, accept)
+		want[encoding]++
+	}
+	after := EncodingStats()
+	for encoding, n := range want {
+		if got := after[encoding] - before[encoding]; got != n {
+			t.Errorf("%s: counted %d, want %d", encoding, got, n)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	const ctype = "text/x-metrics-test"
+	content := strings.Repeat("Hello, World! ", 100)
+	h := New(handlerWith(content, hdrContentType, ctype))
+	short := New(handlerWith("Hello", hdrContentType, ctype))
+	key := MetricsKey{"gzip", ctype}
+
+	before := GetMetrics()
+	get(h, "gzip")
+	get(h, "gzip")
+	get(h, "compress")
+	get(short, "gzip")
+	after := GetMetrics()
+
+	c, prev := after.Compressed[key], before.Compressed[key]
+	if n := c.Responses - prev.Responses; n != 2 {
+		t.Errorf("%d compressed responses, want 2", n)
+	}
+	if in, out := c.BytesIn-prev.BytesIn, c.BytesOut-prev.BytesOut; in != uint64(2*len(content)) || out == 0 || out >= in {
+		t.Errorf("%d bytes in, %d bytes out", in, out)
+	}
+	if c.CompressTime <= prev.CompressTime {
+		t.Errorf("compress time %v", c.CompressTime-prev.CompressTime)
+	}
+	for _, reason := range []string{SkipNotAccepted, SkipLength} {
+		if n := after.Skipped[reason] - before.Skipped[reason]; n != 1 {
+			t.Errorf("%s: skipped %d, want 1", reason, n)
+		}
+	}
+
+	if expvar.Get("compress_test") == nil {
+		PublishExpvar("compress_test")
+	}
+	var vars struct {
+		Encodings  map[string]uint64
+		Skipped    map[string]uint64
+		Compressed map[string]map[string]float64
+	}
+	if err := json.Unmarshal([]byte(expvar.Get("compress_test").String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	got := vars.Compressed[key.String()]
+	if got["responses"] != float64(c.Responses) || got["bytes_in"] != float64(c.BytesIn) ||
+		got["compress_ns"] != float64(c.CompressTime) {
+		t.Errorf("published %v", got)
+	}
+	if vars.Skipped[SkipLength] != after.Skipped[SkipLength] {
+		t.Errorf("published skipped %v", vars.Skipped)
+	}
+}
@@ -0,0 +1,138 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// acceptedCodings is sent by Transport in Accept-Encoding
+const acceptedCodings = "gzip, br, zstd"
+
+/*
+Transport is a http.RoundTripper that asks servers for compressed responses
+and transparently decompresses them. Unlike http.Transport, which only handles
+gzip, it also supports brotli, zstd and deflate:
+
+	client := &http.Client{Transport: &compress.Transport{}}
+
+Like with http.Transport, decompressed responses have no Content-Encoding and
+Content-Length headers, a ContentLength of -1 and Uncompressed set. Requests
+that already carry an Accept-Encoding or Range header get their responses
+unchanged.
+
+Request bodies can be compressed as well, for servers accepting compressed
+uploads:
+
+	client := &http.Client{Transport: &compress.Transport{
+		RequestCoding:    "gzip",
+		RequestMinLength: 1024,
+	}}
+*/
+type Transport struct {
+	// Base makes the actual requests. Defaults to http.DefaultTransport.
+	Base http.RoundTripper
+
+	// RequestCoding compresses request bodies with the registered coding,
+	// e.g. "gzip". Empty leaves request bodies alone.
+	RequestCoding string
+	// RequestMinLength is the size below which request bodies are sent
+	// uncompressed. Compressed bodies are streamed with chunked encoding and
+	// cannot be replayed on redirects or retries.
+	RequestMinLength int
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+// compressBody replaces the body of req with its compressed version, if
+// configured and worthwhile. Only the first RequestMinLength bytes are read up
+// front: shorter bodies are sent as they are and can be retried, longer ones
+// are compressed while they are sent and lose their Content-Length and GetBody.
+func (t *Transport) compressBody(req *http.Request) error {
+	if t.RequestCoding == "" || req.Body == nil || req.Body == http.NoBody ||
+		checkHeaderHas(req.Header, hdrContentEncoding) ||
+		req.ContentLength > 0 && req.ContentLength < int64(t.RequestMinLength) {
+		return nil
+	}
+
+	head := make([]byte, t.RequestMinLength)
+	n, err := io.ReadFull(req.Body, head)
+	head = head[:n]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		req.Body.Close()
+		req.ContentLength = int64(n)
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(head)), nil
+		}
+		req.Body, _ = req.GetBody()
+		return nil
+	}
+	if err != nil {
+		req.Body.Close()
+		return errors.Wrap(err, "Reading request body failed")
+	}
+
+	pr, pw := io.Pipe()
+	z, err := NewWriter(pw, t.RequestCoding, flate.DefaultCompression)
+	if err != nil {
+		req.Body.Close()
+		return err
+	}
+	go func(body io.ReadCloser) {
+		_, err := io.Copy(z, io.MultiReader(bytes.NewReader(head), body))
+		body.Close()
+		if cerr := z.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(errors.Wrap(err, "Compressing request body failed"))
+	}(req.Body)
+
+	req.Body = pr
+	req.ContentLength = -1
+	req.GetBody = nil
+	req.Header.Del(hdrContentLength)
+	req.Header.Set(hdrContentEncoding, toCompType(t.RequestCoding).String())
+	return nil
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request
+	req = req.Clone(req.Context())
+	if err := t.compressBody(req); err != nil {
+		return nil, err
+	}
+	if checkHeaderHas(req.Header, hdrAcceptEncoding) || checkHeaderHas(req.Header, hdrRange) {
+		return t.base().RoundTrip(req)
+	}
+	req.Header.Set(hdrAcceptEncoding, acceptedCodings)
+
+	resp, err := t.base().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method == http.MethodHead || resp.Body == nil || resp.Body == http.NoBody {
+		return resp, nil
+	}
+
+	opens, ok := getDecompressors(resp.Header, 0)
+	if !ok || len(opens) == 0 {
+		return resp, nil
+	}
+	for _, open := range opens {
+		resp.Body = &decompressReader{body: resp.Body, open: open}
+	}
+	resp.Header.Del(hdrContentEncoding)
+	resp.Header.Del(hdrContentLength)
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
@@ -0,0 +1,184 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// encodedServer answers with content encoded as asked for in the "ce" query
+// parameter, regardless of Accept-Encoding, and echoes the Accept-Encoding it
+// received
+func encodedServer(t *testing.T, content string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := []byte(content)
+		if ce := r.URL.Query().Get("ce"); ce != "" {
+			var buf bytes.Buffer
+			z, err := NewWriter(&buf, ce, flate.DefaultCompression)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			z.Write(body)
+			z.Close()
+			body = buf.Bytes()
+			w.Header().Set(hdrContentEncoding, ce)
+		}
+		w.Header().Set("X-Accept-Encoding", r.Header.Get(hdrAcceptEncoding))
+		w.Header().Set(hdrContentLength, strconv.Itoa(len(body)))
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestTransport(t *testing.T) {
+	content := strings.Repeat("Hello, World! ", 100)
+	srv := encodedServer(t, content)
+	client := &http.Client{Transport: &Transport{}}
+
+	for _, tc := range []struct {
+		name           string
+		coding         string
+		acceptEncoding string
+		uncompressed   bool
+	}{
+		{"gzip", "gzip", "", true},
+		{"br", "br", "", true},
+		{"zstd", "zstd", "", true},
+		{"deflate", "deflate", "", true},
+		{"identity", "", "", false},
+		{"caller accept-encoding", "gzip", "gzip", false},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/?ce="+tc.coding, nil)
+		if tc.acceptEncoding != "" {
+			req.Header.Set(hdrAcceptEncoding, tc.acceptEncoding)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		if res.Uncompressed != tc.uncompressed {
+			t.Errorf("%s: Uncompressed %v", tc.name, res.Uncompressed)
+		}
+		wantAE := acceptedCodings
+		if tc.acceptEncoding != "" {
+			wantAE = tc.acceptEncoding
+		}
+		if ae := res.Header.Get("X-Accept-Encoding"); ae != wantAE {
+			t.Errorf("%s: server got Accept-Encoding %q, want %q", tc.name, ae, wantAE)
+		}
+		if !tc.uncompressed {
+			if ce := res.Header.Get(hdrContentEncoding); ce != tc.coding {
+				t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+			}
+			if res.ContentLength != int64(len(body)) {
+				t.Errorf("%s: ContentLength %d, body %d bytes", tc.name, res.ContentLength, len(body))
+			}
+			if tc.coding != "" {
+				body = decode(t, tc.coding, body)
+			}
+		} else {
+			if ce := res.Header.Get(hdrContentEncoding); ce != "" {
+				t.Errorf("%s: Content-Encoding %q", tc.name, ce)
+			}
+			if cl := res.Header.Get(hdrContentLength); cl != "" {
+				t.Errorf("%s: Content-Length %q", tc.name, cl)
+			}
+			if res.ContentLength != -1 {
+				t.Errorf("%s: ContentLength %d", tc.name, res.ContentLength)
+			}
+		}
+		if string(body) != content {
+			t.Errorf("%s: got %d bytes, want %d", tc.name, len(body), len(content))
+		}
+	}
+}
+
+func TestTransportRequestCoding(t *testing.T) {
+	const minLength = 1024
+	type received struct {
+		encoding      string
+		contentLength int64
+		body          string
+	}
+	var got received
+	upload := Decompress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		got.body = string(body)
+	}))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = received{encoding: r.Header.Get(hdrContentEncoding), contentLength: r.ContentLength}
+		upload.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	tr := &Transport{RequestCoding: "gzip", RequestMinLength: minLength}
+	client := &http.Client{Transport: tr}
+
+	short := strings.Repeat("a", minLength-1)
+	long := strings.Repeat("Hello, World! ", 1000)
+	for _, tc := range []struct {
+		name     string
+		content  string
+		length   bool
+		encoding string
+	}{
+		{"short", short, true, ""},
+		{"short unknown length", short, false, ""},
+		{"minimum", strings.Repeat("a", minLength), true, "gzip"},
+		{"long", long, true, "gzip"},
+		{"long unknown length", long, false, "gzip"},
+	} {
+		var body io.Reader = strings.NewReader(tc.content)
+		if !tc.length {
+			body = io.MultiReader(body)
+		}
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, body)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: status %d", tc.name, res.StatusCode)
+		}
+		if got.encoding != tc.encoding {
+			t.Errorf("%s: server got Content-Encoding %q, want %q", tc.name, got.encoding, tc.encoding)
+		}
+		wantCL := int64(len(tc.content))
+		if tc.encoding != "" {
+			wantCL = -1
+		}
+		if got.contentLength != wantCL {
+			t.Errorf("%s: server got ContentLength %d, want %d", tc.name, got.contentLength, wantCL)
+		}
+		if got.body != tc.content {
+			t.Errorf("%s: server got %d bytes, want %d", tc.name, len(got.body), len(tc.content))
+		}
+
+		req, _ = http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(tc.content))
+		if err := tr.compressBody(req); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if (req.GetBody != nil) != (tc.encoding == "") {
+			t.Errorf("%s: GetBody set %v", tc.name, req.GetBody != nil)
+		}
+		req.Body.Close()
+	}
+}